@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/linkedin/goavro/v2"
+)
+
+const (
+	// avro complex type kinds, primitive kinds are their type names
+	avroRecord = "record"
+	avroEnum   = "enum"
+	avroArray  = "array"
+	avroMap    = "map"
+	avroFixed  = "fixed"
+	avroUnion  = "union"
+)
+
+// avroDecoder decodes records encoded with Avro binary or JSON encoding of the schema
+type avroDecoder struct {
+	codec    *goavro.Codec
+	root     *avroType
+	encoding string
+}
+
+// avroType is the part of Avro schema needed to convert decoded values and derive
+// table schema. Named types are shared so recursive schemas make cycles
+type avroType struct {
+	kind      string
+	name      string
+	logical   string
+	precision int
+	scale     int
+	fields    []*avroField
+	items     *avroType
+	branches  []*avroType
+}
+
+type avroField struct {
+	name string
+	typ  *avroType
+}
+
+func newAvroDecoder(schema []byte, encoding string) (*avroDecoder, error) {
+	codec, err := goavro.NewCodec(string(schema))
+	if err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %v", err)
+	}
+	var spec interface{}
+	if err := json.Unmarshal(schema, &spec); err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %v", err)
+	}
+	root, err := (&avroParser{named: make(map[string]*avroType)}).parse(spec, "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %v", err)
+	}
+	if root.kind != avroRecord {
+		return nil, fmt.Errorf("avro schema must be record, got %s", root.kind)
+	}
+	return &avroDecoder{codec: codec, root: root, encoding: encoding}, nil
+}
+
+func (d *avroDecoder) Decode(data []byte, attrs map[string]string) (simpleRecord, error) {
+	var native interface{}
+	var err error
+	switch enc := messageEncoding(attrs, d.encoding); enc {
+	case encodingBinary:
+		var rest []byte
+		if native, rest, err = d.codec.NativeFromBinary(data); err == nil && len(rest) > 0 {
+			err = fmt.Errorf("%d bytes left after record", len(rest))
+		}
+	case encodingJSON:
+		native, _, err = d.codec.NativeFromTextual(data)
+	default:
+		return nil, fmt.Errorf("unsupported message encoding: %q", enc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, ok := avroValue(d.root, native).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("avro payload is not record")
+	}
+	rec := make(simpleRecord, len(m))
+	for k, v := range m {
+		rec[k] = v
+	}
+	return rec, nil
+}
+
+// Schema returns table schema of the avro record, nil when some of its types can't be
+// mapped onto column types (recursive types, unions of multiple types) so it's inferred
+func (d *avroDecoder) Schema() bigquery.Schema {
+	schema, err := avroSchema(d.root, make(map[*avroType]bool))
+	if err != nil {
+		logger.Printf("avro schema not mapped onto table schema: %v", err)
+		return nil
+	}
+	return schema
+}
+
+// avroParser parses schema JSON into types, resolving named type references
+type avroParser struct {
+	named map[string]*avroType
+}
+
+func (p *avroParser) parse(spec interface{}, namespace string) (*avroType, error) {
+	switch t := spec.(type) {
+	case string:
+		switch t {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroType{kind: t}, nil
+		}
+		if nt, ok := p.named[fullAvroName(t, namespace)]; ok {
+			return nt, nil
+		}
+		if nt, ok := p.named[t]; ok {
+			return nt, nil
+		}
+		return nil, fmt.Errorf("unknown type: %s", t)
+	case []interface{}:
+		u := &avroType{kind: avroUnion}
+		for _, item := range t {
+			b, err := p.parse(item, namespace)
+			if err != nil {
+				return nil, err
+			}
+			u.branches = append(u.branches, b)
+		}
+		return u, nil
+	case map[string]interface{}:
+		kind, ok := t["type"].(string)
+		if !ok {
+			return p.parse(t["type"], namespace)
+		}
+		logical, _ := t["logicalType"].(string)
+		precision, _ := t["precision"].(float64)
+		scale, _ := t["scale"].(float64)
+		switch kind {
+		case avroRecord, "error", avroEnum, avroFixed:
+			name, _ := t["name"].(string)
+			if ns, ok := t["namespace"].(string); ok && !strings.Contains(name, ".") {
+				namespace = ns
+			}
+			name = fullAvroName(name, namespace)
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				namespace = name[:i]
+			}
+			at := &avroType{kind: kind, name: name, logical: logical, precision: int(precision), scale: int(scale)}
+			p.named[name] = at
+			if kind == avroEnum || kind == avroFixed {
+				return at, nil
+			}
+			at.kind = avroRecord
+			fields, _ := t["fields"].([]interface{})
+			for _, item := range fields {
+				f, _ := item.(map[string]interface{})
+				fname, _ := f["name"].(string)
+				ft, err := p.parse(f["type"], namespace)
+				if err != nil {
+					return nil, fmt.Errorf("field %s: %v", fname, err)
+				}
+				at.fields = append(at.fields, &avroField{name: fname, typ: ft})
+			}
+			return at, nil
+		case avroArray, avroMap:
+			key := "items"
+			if kind == avroMap {
+				key = "values"
+			}
+			items, err := p.parse(t[key], namespace)
+			if err != nil {
+				return nil, err
+			}
+			return &avroType{kind: kind, items: items}, nil
+		default:
+			at, err := p.parse(kind, namespace)
+			if err != nil || at.name != "" {
+				return at, err
+			}
+			at.logical, at.precision, at.scale = logical, int(precision), int(scale)
+			return at, nil
+		}
+	default:
+		return nil, fmt.Errorf("invalid type: %v", spec)
+	}
+}
+
+func fullAvroName(name, namespace string) string {
+	if namespace == "" || strings.Contains(name, ".") {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// unionName returns the name decoder uses as key of union values of the type
+func (t *avroType) unionName() string {
+	switch {
+	case t.name != "":
+		return t.name
+	case t.logical != "":
+		return t.kind + "." + t.logical
+	default:
+		return t.kind
+	}
+}
+
+func (t *avroType) field(name string) *avroType {
+	for _, f := range t.fields {
+		if f.name == name {
+			return f.typ
+		}
+	}
+	return nil
+}
+
+// avroValue converts decoded Avro value into decoded JSON form, unwrapping unions
+// and turning maps into key/value records. Type is nil when it's not known
+func avroValue(t *avroType, v interface{}) interface{} {
+	if t != nil && t.kind == avroUnion {
+		m, ok := v.(map[string]interface{})
+		if !ok || len(m) != 1 {
+			return avroValue(nil, v)
+		}
+		for name, item := range m {
+			for _, b := range t.branches {
+				if b.unionName() == name {
+					return avroValue(b, item)
+				}
+			}
+			return avroValue(nil, item)
+		}
+	}
+
+	switch val := v.(type) {
+	case nil, bool, string:
+		return val
+	case int:
+		return json.Number(strconv.Itoa(val))
+	case int32:
+		return json.Number(strconv.FormatInt(int64(val), 10))
+	case int64:
+		return json.Number(strconv.FormatInt(val, 10))
+	case float32:
+		return floatValue(float64(val), 32)
+	case float64:
+		return floatValue(val, 64)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(val)
+	case *big.Rat:
+		scale := bigquery.NumericScaleDigits
+		if t != nil {
+			scale = t.scale
+		}
+		return val.FloatString(scale)
+	case time.Time:
+		if t != nil && t.logical == "date" {
+			return val.UTC().Format("2006-01-02")
+		}
+		return val.UTC().Format(time.RFC3339Nano)
+	case time.Duration:
+		return time.Time{}.Add(val).Format("15:04:05.999999")
+	case []interface{}:
+		var items *avroType
+		if t != nil {
+			items = t.items
+		}
+		list := make([]interface{}, 0, len(val))
+		for _, item := range val {
+			list = append(list, avroValue(items, item))
+		}
+		return list
+	case map[string]interface{}:
+		if t != nil && t.kind == avroMap {
+			keys := make([]string, 0, len(val))
+			for k := range val {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			list := make([]interface{}, 0, len(val))
+			for _, k := range keys {
+				list = append(list, map[string]interface{}{"key": k, "value": avroValue(t.items, val[k])})
+			}
+			return list
+		}
+		rec := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			var ft *avroType
+			if t != nil {
+				ft = t.field(k)
+			}
+			rec[k] = avroValue(ft, item)
+		}
+		return rec
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// avroSchema returns table schema of the record type, seen are the records being mapped
+func avroSchema(t *avroType, seen map[*avroType]bool) (bigquery.Schema, error) {
+	if seen[t] {
+		return nil, fmt.Errorf("recursive type %s", t.name)
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	schema := make(bigquery.Schema, 0, len(t.fields))
+	for _, f := range t.fields {
+		fs, err := avroFieldSchema(f.name, f.typ, seen)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", f.name, err)
+		}
+		schema = append(schema, fs)
+	}
+	return schema, nil
+}
+
+func avroFieldSchema(name string, t *avroType, seen map[*avroType]bool) (*bigquery.FieldSchema, error) {
+	f := &bigquery.FieldSchema{Name: name}
+	switch t.kind {
+	case avroUnion:
+		var types []*avroType
+		for _, b := range t.branches {
+			if b.kind != "null" {
+				types = append(types, b)
+			}
+		}
+		if len(types) != 1 {
+			return nil, fmt.Errorf("union of %d types", len(types))
+		}
+		return avroFieldSchema(name, types[0], seen)
+	case "boolean":
+		f.Type = bigquery.BooleanFieldType
+	case "int", "long":
+		switch t.logical {
+		case "date":
+			f.Type = bigquery.DateFieldType
+		case "time-millis", "time-micros":
+			f.Type = bigquery.TimeFieldType
+		case "timestamp-millis", "timestamp-micros":
+			f.Type = bigquery.TimestampFieldType
+		default:
+			f.Type = bigquery.IntegerFieldType
+		}
+	case "float", "double":
+		f.Type = bigquery.FloatFieldType
+	case "bytes", avroFixed:
+		f.Type = bigquery.BytesFieldType
+		if t.logical == "decimal" {
+			f.Type = bigquery.NumericFieldType
+			if t.scale > bigquery.NumericScaleDigits || t.precision-t.scale > bigquery.NumericPrecisionDigits-bigquery.NumericScaleDigits {
+				f.Type = bigquery.BigNumericFieldType
+			}
+		}
+	case "string", avroEnum:
+		f.Type = bigquery.StringFieldType
+	case avroRecord:
+		schema, err := avroSchema(t, seen)
+		if err != nil {
+			return nil, err
+		}
+		f.Type = bigquery.RecordFieldType
+		f.Schema = schema
+	case avroArray:
+		items, err := avroFieldSchema(name, t.items, seen)
+		if err != nil {
+			return nil, err
+		}
+		if items.Repeated {
+			return nil, fmt.Errorf("nested arrays")
+		}
+		items.Repeated = true
+		return items, nil
+	case avroMap:
+		value, err := avroFieldSchema("value", t.items, seen)
+		if err != nil {
+			return nil, err
+		}
+		f.Type = bigquery.RecordFieldType
+		f.Repeated = true
+		f.Schema = bigquery.Schema{{Name: "key", Type: bigquery.StringFieldType}, value}
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t.kind)
+	}
+	return f, nil
+}
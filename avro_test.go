@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/linkedin/goavro/v2"
+)
+
+const testAvroSchema = `{
+	"type": "record", "name": "Order", "namespace": "shop",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "qty", "type": "int"},
+		{"name": "note", "type": ["null", "string"], "default": null},
+		{"name": "created", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "updated", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "day", "type": {"type": "int", "logicalType": "date"}},
+		{"name": "price", "type": {"type": "bytes", "logicalType": "decimal", "precision": 10, "scale": 2}},
+		{"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["NEW", "DONE"]}},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "attrs", "type": {"type": "map", "values": "long"}},
+		{"name": "ship", "type": ["null", {"type": "record", "name": "Address", "fields": [
+			{"name": "city", "type": "string"}
+		]}]}
+	]
+}`
+
+func TestAvroDecoder(t *testing.T) {
+	codec, err := goavro.NewCodec(testAvroSchema)
+	if err != nil {
+		t.Fatalf("error creating codec: %v", err)
+	}
+	ts := time.Date(2022, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	native := map[string]interface{}{
+		"id":      "o1",
+		"qty":     int32(3),
+		"note":    goavro.Union("string", "x"),
+		"created": ts,
+		"updated": ts,
+		"day":     time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC),
+		"price":   big.NewRat(1234, 100),
+		"status":  "NEW",
+		"tags":    []interface{}{"a", "b"},
+		"attrs":   map[string]interface{}{"b": int64(2), "a": int64(1)},
+		"ship":    goavro.Union("shop.Address", map[string]interface{}{"city": "Paris"}),
+	}
+	binary, err := codec.BinaryFromNative(nil, native)
+	if err != nil {
+		t.Fatalf("error encoding binary: %v", err)
+	}
+	textual, err := codec.TextualFromNative(nil, native)
+	if err != nil {
+		t.Fatalf("error encoding JSON: %v", err)
+	}
+
+	want := simpleRecord{
+		"id":      "o1",
+		"qty":     json.Number("3"),
+		"note":    "x",
+		"created": "2022-01-02T03:04:05.123Z",
+		"updated": "2022-01-02T03:04:05.123456Z",
+		"day":     "2022-01-02",
+		"price":   "12.34",
+		"status":  "NEW",
+		"tags":    []interface{}{"a", "b"},
+		"attrs": []interface{}{
+			map[string]interface{}{"key": "a", "value": json.Number("1")},
+			map[string]interface{}{"key": "b", "value": json.Number("2")},
+		},
+		"ship": map[string]interface{}{"city": "Paris"},
+	}
+	d, err := newAvroDecoder([]byte(testAvroSchema), encodingBinary)
+	if err != nil {
+		t.Fatalf("error creating decoder: %v", err)
+	}
+	for enc, data := range map[string][]byte{encodingBinary: binary, encodingJSON: textual} {
+		rec, err := d.Decode(data, map[string]string{schemaEncodingAttribute: enc})
+		if err != nil {
+			t.Fatalf("%s: error decoding: %v", enc, err)
+		}
+		if !reflect.DeepEqual(rec, want) {
+			t.Errorf("%s: got %v, want %v", enc, rec, want)
+		}
+	}
+
+	// trailing data is not part of the record
+	if _, err := d.Decode(append(binary, 0), nil); err == nil {
+		t.Errorf("expected error for trailing bytes")
+	}
+}
+
+func TestAvroSchema(t *testing.T) {
+	d, err := newAvroDecoder([]byte(testAvroSchema), encodingBinary)
+	if err != nil {
+		t.Fatalf("error creating decoder: %v", err)
+	}
+	want := bigquery.Schema{
+		{Name: "id", Type: bigquery.StringFieldType},
+		{Name: "qty", Type: bigquery.IntegerFieldType},
+		{Name: "note", Type: bigquery.StringFieldType},
+		{Name: "created", Type: bigquery.TimestampFieldType},
+		{Name: "updated", Type: bigquery.TimestampFieldType},
+		{Name: "day", Type: bigquery.DateFieldType},
+		{Name: "price", Type: bigquery.NumericFieldType},
+		{Name: "status", Type: bigquery.StringFieldType},
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+		{Name: "attrs", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+			{Name: "key", Type: bigquery.StringFieldType},
+			{Name: "value", Type: bigquery.IntegerFieldType},
+		}},
+		{Name: "ship", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "city", Type: bigquery.StringFieldType},
+		}},
+	}
+	if got := d.Schema(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got schema %v, want %v", got, want)
+	}
+
+	// types without column equivalent leave the schema to be inferred
+	for name, schema := range map[string]string{
+		"union": `{"type": "record", "name": "U", "fields": [{"name": "v", "type": ["int", "string"]}]}`,
+		"recursive": `{"type": "record", "name": "Node", "fields": [
+			{"name": "next", "type": ["null", "Node"]}
+		]}`,
+	} {
+		d, err := newAvroDecoder([]byte(schema), encodingBinary)
+		if err != nil {
+			t.Fatalf("%s: error creating decoder: %v", name, err)
+		}
+		if got := d.Schema(); got != nil {
+			t.Errorf("%s: got schema %v, want none", name, got)
+		}
+	}
+
+	if _, err := newAvroDecoder([]byte(`"string"`), encodingBinary); err == nil {
+		t.Errorf("expected error for schema which is not record")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// bigQuerySink streams records into BigQuery table using insertAll.
+// Rows with fields which are not in the table are rejected rather than silently truncated
+type bigQuerySink struct {
+	mu       sync.Mutex
+	client   *bigquery.Client
+	inserter *bigquery.Inserter
+	pending  []*Record
+}
+
+// NewBigQuerySink creates sink streaming records into ds.table
+func NewBigQuerySink(ctx context.Context, ds, table string) (s Sink, err error) {
+	client, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	inserter := client.Dataset(ds).Table(table).Inserter()
+	inserter.SkipInvalidRows = true
+
+	return &bigQuerySink{
+		client:   client,
+		inserter: inserter,
+		pending:  make([]*Record, 0),
+	}, nil
+}
+
+func (s *bigQuerySink) Append(ctx context.Context, rec *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, rec)
+	return nil
+}
+
+// Flush puts pending records, rows rejected by BigQuery are reported in their results
+// while any other error fails the whole flush. Rows rejected for unknown fields are retried
+// while schema evolution is on as the columns may have been just added
+func (s *bigQuerySink) Flush(ctx context.Context) ([]*RecordResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() {
+		s.pending = make([]*Record, 0)
+	}()
+	s.pending = withdrawCanceled(s.pending)
+
+	rejected := make(map[int]error)
+	retry := make(map[int]bool)
+	if err := s.inserter.Put(ctx, s.pending); err != nil {
+		var multiErr bigquery.PutMultiError
+		if !errors.As(err, &multiErr) {
+			return nil, fmt.Errorf("bigquery put: %v", err)
+		}
+		for _, rowErr := range multiErr {
+			rejected[rowErr.RowIndex] = rowErr.Errors
+			retry[rowErr.RowIndex] = cfg.Schema.Evolve == evolveModeOn && hasUnknownFieldError(rowErr.Errors)
+		}
+	}
+
+	results := make([]*RecordResult, 0, len(s.pending))
+	for i, rec := range s.pending {
+		results = append(results, &RecordResult{Record: rec, Err: rejected[i], Retry: retry[i]})
+	}
+	return results, nil
+}
+
+func (s *bigQuerySink) Close() error {
+	return s.client.Close()
+}
+
+// hasUnknownFieldError tells whether any of the row errors is for field which is not in the table
+func hasUnknownFieldError(errs bigquery.MultiError) bool {
+	for _, err := range errs {
+		if strings.Contains(strings.ToLower(err.Error()), "no such field") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestHasUnknownFieldError(t *testing.T) {
+	unknown := bigquery.MultiError{
+		&bigquery.Error{Reason: "invalid", Message: "Field value of ts cannot be empty."},
+		&bigquery.Error{Reason: "invalid", Message: "no such field: extra."},
+	}
+	if !hasUnknownFieldError(unknown) {
+		t.Errorf("expected unknown field error in %v", unknown)
+	}
+	invalid := bigquery.MultiError{&bigquery.Error{Reason: "invalid", Message: "Cannot convert value to integer."}}
+	if hasUnknownFieldError(invalid) {
+		t.Errorf("unexpected unknown field error in %v", invalid)
+	}
+	if hasUnknownFieldError(nil) {
+		t.Errorf("unexpected unknown field error without errors")
+	}
+}
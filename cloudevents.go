@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	// event context attributes written into columns
+	eventID      = "id"
+	eventSource  = "source"
+	eventType    = "type"
+	eventTime    = "time"
+	eventSubject = "subject"
+
+	// prefix of binary mode context attributes in Pub/Sub protocol binding
+	eventAttributePrefix = "ce-"
+)
+
+var (
+	// event columns in the order they are added to the table schema
+	eventColumns = []string{eventID, eventSource, eventType, eventTime, eventSubject}
+)
+
+// CloudEvents unwraps events published in binary mode, with context attributes in
+// ce- prefixed message attributes and data as message data, or in structured mode,
+// as JSON event in message data. Context attributes are written into columns named
+// by the attribute with prefix and the event data is decoded as the payload
+type CloudEvents struct {
+	prefix string
+}
+
+// NewCloudEvents creates events unwrapper, nil when CloudEvents mode is not enabled
+func NewCloudEvents(cfg CloudEventsConfig) (*CloudEvents, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.Prefix == "" {
+		return nil, fmt.Errorf("cloudevents column prefix required")
+	}
+	return &CloudEvents{prefix: cfg.Prefix}, nil
+}
+
+// Unwrap returns context attributes and data of the event in message data.
+// Data is nil when the event has none
+func (e *CloudEvents) Unwrap(msg *Message, data []byte) (map[string]string, []byte, error) {
+	if msg.Attributes[eventAttributePrefix+"specversion"] != "" {
+		event := make(map[string]string, len(eventColumns))
+		for _, name := range eventColumns {
+			if v, ok := msg.Attributes[eventAttributePrefix+name]; ok {
+				event[name] = v
+			}
+		}
+		return event, data, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, nil, fmt.Errorf("invalid cloudevent: %v", err)
+	}
+	if _, ok := fields["specversion"]; !ok {
+		return nil, nil, fmt.Errorf("invalid cloudevent: specversion not set")
+	}
+	event := make(map[string]string, len(eventColumns))
+	for _, name := range eventColumns {
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, nil, fmt.Errorf("invalid cloudevent %s: %v", name, err)
+		}
+		event[name] = v
+	}
+
+	if raw, ok := fields["data_base64"]; ok {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, nil, fmt.Errorf("invalid cloudevent data_base64: %v", err)
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid cloudevent data_base64: %v", err)
+		}
+		return event, b, nil
+	}
+	raw, ok := fields["data"]
+	if !ok || string(raw) == "null" {
+		return event, nil, nil
+	}
+	// string data is text payload, anything else is JSON payload
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return event, []byte(s), nil
+	}
+	return event, raw, nil
+}
+
+// Add sets the event columns of record overwriting fields of the same name,
+// there is nothing to set on nil record of data not decoded to record
+func (e *CloudEvents) Add(rec simpleRecord, event map[string]string) {
+	if rec == nil {
+		return
+	}
+	for _, name := range eventColumns {
+		if v, ok := event[name]; ok {
+			rec[e.prefix+name] = v
+		}
+	}
+}
+
+// WithSchema returns copy of schema with the event columns
+func (e *CloudEvents) WithSchema(schema bigquery.Schema) bigquery.Schema {
+	out := make(bigquery.Schema, 0, len(schema)+len(eventColumns))
+	out = append(out, schema...)
+	for _, name := range eventColumns {
+		t := bigquery.StringFieldType
+		if name == eventTime {
+			t = bigquery.TimestampFieldType
+		}
+		out = append(out, &bigquery.FieldSchema{Name: e.prefix + name, Type: t})
+	}
+	return out
+}
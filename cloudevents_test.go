@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPumpNullEvents(t *testing.T) {
+	p := testPipeline(t)
+	cfg.CloudEvents.Enabled = true
+
+	written := make(map[string]*Record)
+	memoryReject = func(rec *Record) (bool, error) {
+		written[rec.Msg.ID] = rec
+		return false, nil
+	}
+	binary := testMessage("binary-null", `null`)
+	binary.Attributes = map[string]string{
+		"ce-specversion": "1.0",
+		"ce-id":          "1",
+		"ce-type":        "test",
+	}
+	src := newMemorySource([]*Message{
+		binary,
+		testMessage("structured-null", `{"specversion":"1.0","id":"2","type":"test","data":null}`),
+	})
+	r, err := pump(p, src)
+	if err != nil {
+		t.Fatalf("error on pump: %v", err)
+	}
+	if r.Accepted != 1 || r.Rejected != 1 {
+		t.Errorf("got %d accepted, %d rejected, want 1, 1", r.Accepted, r.Rejected)
+	}
+
+	// binary mode null data is payload which does not decode to record
+	if _, ok := deadLettered(t)["binary-null"]; !ok {
+		t.Errorf("binary mode event with null data not dead-lettered")
+	}
+	// structured mode null data is event without data
+	rec, ok := written["structured-null"]
+	if !ok {
+		t.Fatalf("structured mode event with null data not written")
+	}
+	if rec.Values["ce_id"] != "2" || rec.Values["ce_type"] != "test" || len(rec.Values) != 2 {
+		t.Errorf("written %v, want event columns only", rec.Values)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// compressions of message data
+	compressionGzip   = "gzip"
+	compressionZstd   = "zstd"
+	compressionSnappy = "snappy"
+
+	// zstd frames commonly declare 8MB window which the decoder allocates,
+	// decompressed data is still limited to the max size when it's lower
+	zstdMinMemory = 8 << 20
+)
+
+var (
+	// magic bytes data compressed with each compression starts with,
+	// snappy block format has none so it's only known from the attribute
+	compressionMagic = map[string][]byte{
+		compressionGzip:   {0x1f, 0x8b},
+		compressionZstd:   {0x28, 0xb5, 0x2f, 0xfd},
+		compressionSnappy: []byte("\xff\x06\x00\x00sNaPpY"),
+	}
+
+	// attribute values naming the compressions, identity means not compressed
+	compressionNames = map[string]string{
+		"identity":  "",
+		"gzip":      compressionGzip,
+		"x-gzip":    compressionGzip,
+		"zstd":      compressionZstd,
+		"zstandard": compressionZstd,
+		"snappy":    compressionSnappy,
+		"x-snappy":  compressionSnappy,
+	}
+)
+
+// Decompressor decompresses message data compressed by publishers. Compression is named by
+// the message attribute, or detected from the magic bytes data starts with when it's missing
+type Decompressor struct {
+	attribute string
+	detect    bool
+	maxSize   int64
+}
+
+// NewDecompressor creates decompressor limiting decompressed data to max size bytes,
+// nil when there is neither attribute nor detection
+func NewDecompressor(cfg CompressionConfig) (*Decompressor, error) {
+	if cfg.Attribute == "" && !cfg.Detect {
+		return nil, nil
+	}
+	if cfg.MaxSize <= 0 {
+		return nil, fmt.Errorf("max decompressed size must be positive, got %d", cfg.MaxSize)
+	}
+	return &Decompressor{
+		attribute: cfg.Attribute,
+		detect:    cfg.Detect,
+		maxSize:   int64(cfg.MaxSize),
+	}, nil
+}
+
+// Decompress returns decompressed data of the message, data as is when it's not compressed
+func (d *Decompressor) Decompress(msg *Message) ([]byte, error) {
+	compression, err := d.compression(msg)
+	if err != nil {
+		return nil, err
+	}
+	switch compression {
+	case compressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(msg.Data))
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %v", err)
+		}
+		defer r.Close()
+		return d.read(compression, r)
+	case compressionZstd:
+		mem := uint64(d.maxSize)
+		if mem < zstdMinMemory {
+			mem = zstdMinMemory
+		}
+		r, err := zstd.NewReader(bytes.NewReader(msg.Data),
+			zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(mem))
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %v", err)
+		}
+		defer r.Close()
+		return d.read(compression, r)
+	case compressionSnappy:
+		if bytes.HasPrefix(msg.Data, compressionMagic[compressionSnappy]) {
+			return d.read(compression, snappy.NewReader(bytes.NewReader(msg.Data)))
+		}
+		n, err := snappy.DecodedLen(msg.Data)
+		if err != nil {
+			return nil, fmt.Errorf("snappy: %v", err)
+		}
+		if int64(n) > d.maxSize {
+			return nil, fmt.Errorf("snappy: decompressed data exceeds %d bytes", d.maxSize)
+		}
+		b, err := snappy.Decode(nil, msg.Data)
+		if err != nil {
+			return nil, fmt.Errorf("snappy: %v", err)
+		}
+		return b, nil
+	default:
+		return msg.Data, nil
+	}
+}
+
+// compression returns compression named by the attribute or detected from the data,
+// empty when data isn't compressed
+func (d *Decompressor) compression(msg *Message) (string, error) {
+	if d.attribute != "" {
+		for k, v := range msg.Attributes {
+			if !strings.EqualFold(k, d.attribute) || strings.TrimSpace(v) == "" {
+				continue
+			}
+			compression, ok := compressionNames[strings.ToLower(strings.TrimSpace(v))]
+			if !ok {
+				return "", fmt.Errorf("unsupported compression: %q", v)
+			}
+			return compression, nil
+		}
+	}
+	if d.detect {
+		for compression, magic := range compressionMagic {
+			if bytes.HasPrefix(msg.Data, magic) {
+				return compression, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// read reads decompressed data failing once there is more than max size of it
+func (d *Decompressor) read(compression string, r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, d.maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", compression, err)
+	}
+	if int64(len(b)) > d.maxSize {
+		return nil, fmt.Errorf("%s: decompressed data exceeds %d bytes", compression, d.maxSize)
+	}
+	return b, nil
+}
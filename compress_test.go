@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecompress(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"n":1}`), 100)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(data)
+	gw.Close()
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("error creating zstd writer: %v", err)
+	}
+	zs := zw.EncodeAll(data, nil)
+	zw.Close()
+	var framed bytes.Buffer
+	sw := snappy.NewBufferedWriter(&framed)
+	sw.Write(data)
+	sw.Close()
+
+	tests := []struct {
+		name        string
+		attribute   string
+		compressed  []byte
+		detectable  bool
+		compression string
+	}{
+		{"gzip", "gzip", gz.Bytes(), true, compressionGzip},
+		{"zstd", "zstd", zs, true, compressionZstd},
+		{"snappy framed", "snappy", framed.Bytes(), true, compressionSnappy},
+		{"snappy block", "x-snappy", snappy.Encode(nil, data), false, compressionSnappy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// data of exactly max size is decompressed, one more byte is over the limit
+			at, _ := NewDecompressor(CompressionConfig{Attribute: "encoding", MaxSize: len(data)})
+			over, _ := NewDecompressor(CompressionConfig{Attribute: "encoding", MaxSize: len(data) - 1})
+			msg := &Message{Data: tt.compressed, Attributes: map[string]string{"Encoding": tt.attribute}}
+			got, err := at.Decompress(msg)
+			if err != nil {
+				t.Fatalf("error decompressing: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decompressed %d bytes, want the original %d", len(got), len(data))
+			}
+			if _, err := over.Decompress(msg); err == nil {
+				t.Errorf("expected error over max size")
+			}
+
+			detector, _ := NewDecompressor(CompressionConfig{Detect: true, MaxSize: len(data)})
+			msg = &Message{Data: tt.compressed}
+			if got, _ := detector.compression(msg); (got == tt.compression) != tt.detectable {
+				t.Errorf("detected %q, want detected %v", got, tt.detectable)
+			}
+		})
+	}
+}
+
+func TestDecompressUncompressed(t *testing.T) {
+	d, err := NewDecompressor(CompressionConfig{Attribute: "encoding", Detect: true, MaxSize: 10})
+	if err != nil {
+		t.Fatalf("error creating decompressor: %v", err)
+	}
+	data := []byte(`{"data":"longer than max size"}`)
+	for _, attrs := range []map[string]string{
+		{"encoding": "identity"},
+		{"encoding": " "},
+		{},
+	} {
+		got, err := d.Decompress(&Message{Data: data, Attributes: attrs})
+		if err != nil {
+			t.Fatalf("%v: error decompressing: %v", attrs, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%v: got %q, want data as is", attrs, got)
+		}
+	}
+
+	if _, err := d.Decompress(&Message{Data: data, Attributes: map[string]string{"encoding": "brotli"}}); err == nil {
+		t.Errorf("expected error for unsupported compression")
+	}
+	if d, err := NewDecompressor(CompressionConfig{MaxSize: 10}); d != nil || err != nil {
+		t.Errorf("got decompressor %v, error %v, want none without attribute or detection", d, err)
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the service configuration loaded from YAML or JSON config file
+// with env vars overriding the file settings they are tagged with
+type Config struct {
+	Port    string `yaml:"port" env:"PORT"`
+	Release string `yaml:"release" env:"RELEASE"`
+	Debug   int    `yaml:"debug" env:"DEBUG"`
+	Token   string `yaml:"token" env:"TOKEN"`
+
+	// single pipeline used when no pipelines are declared,
+	// batch size and limits are also the defaults of declared pipelines
+	Subscription string      `yaml:"subscription" env:"SUB"`
+	Dataset      string      `yaml:"dataset" env:"DATASET,DATSET"`
+	Table        string      `yaml:"table" env:"TABLE"`
+	BatchSize    int         `yaml:"batch_size" env:"BATCH_SIZE"`
+	MaxStall     int         `yaml:"max_stall" env:"MAX_STALL"`
+	MaxDuration  int         `yaml:"max_duration" env:"MAX_DURATION"`
+	Pipelines    []*Pipeline `yaml:"pipelines"`
+
+	// env vars which could not be applied, reported along with the other problems
+	envErrors []error
+
+	Source      SourceConfig      `yaml:"source"`
+	Push        PushConfig        `yaml:"push"`
+	Compression CompressionConfig `yaml:"compression"`
+	CloudEvents CloudEventsConfig `yaml:"cloudevents"`
+	Payload     PayloadConfig     `yaml:"payload"`
+	Filter      FilterConfig      `yaml:"filter"`
+	Transform   TransformConfig   `yaml:"transform"`
+	Script      ScriptConfig      `yaml:"script"`
+	Metadata    MetadataConfig    `yaml:"metadata"`
+	Sink        SinkConfig        `yaml:"sink"`
+	Schema      SchemaConfig      `yaml:"schema"`
+	CreateTable TableConfig       `yaml:"create_table"`
+	Routing     RoutingConfig     `yaml:"routing"`
+	InsertID    InsertIDConfig    `yaml:"insert_id"`
+	DeadLetter  DeadLetterConfig  `yaml:"dead_letter"`
+}
+
+// SourceConfig configures where messages come from
+type SourceConfig struct {
+	Type string `yaml:"type" env:"SOURCE"`
+	File string `yaml:"file" env:"SOURCE_FILE"`
+}
+
+// PushConfig configures the push delivery endpoint. Requests carry OIDC token pubsub signs
+// for the audience and service account, or the access token when no audience is set.
+// Flush interval in milliseconds bounds how long pushed messages wait for their batch
+type PushConfig struct {
+	Audience       string `yaml:"audience" env:"PUSH_AUDIENCE"`
+	ServiceAccount string `yaml:"service_account" env:"PUSH_SERVICE_ACCOUNT"`
+	FlushInterval  int    `yaml:"flush_interval_ms" env:"PUSH_FLUSH_INTERVAL_MS"`
+}
+
+// CompressionConfig configures decompression of message data, compression is named by
+// the attribute or detected from the data. Max size limits decompressed data in bytes
+type CompressionConfig struct {
+	Attribute string `yaml:"attribute" env:"COMPRESSION_ATTRIBUTE"`
+	Detect    bool   `yaml:"detect" env:"COMPRESSION_DETECT"`
+	MaxSize   int    `yaml:"max_size" env:"COMPRESSION_MAX_SIZE"`
+}
+
+// CloudEventsConfig configures unwrapping of binary or structured mode CloudEvents,
+// event context attributes are written into columns named with the prefix
+type CloudEventsConfig struct {
+	Enabled bool   `yaml:"enabled" env:"CLOUDEVENTS"`
+	Prefix  string `yaml:"prefix" env:"CLOUDEVENTS_PREFIX"`
+}
+
+// PayloadConfig configures how message data is decoded, raw format writes
+// the whole data into single column of the configured type. Avro and protobuf
+// formats decode data of the schema, set inline or in schema file, using the encoding
+// Pub/Sub sets on the message or the configured one when it's missing.
+// Batch explodes JSON array or NDJSON data into rows numbered in the index column
+type PayloadConfig struct {
+	Format      string `yaml:"format" env:"PAYLOAD_FORMAT"`
+	Column      string `yaml:"column" env:"PAYLOAD_COLUMN"`
+	Type        string `yaml:"type" env:"PAYLOAD_TYPE"`
+	Encoding    string `yaml:"encoding" env:"PAYLOAD_ENCODING"`
+	Schema      string `yaml:"schema" env:"PAYLOAD_SCHEMA"`
+	SchemaFile  string `yaml:"schema_file" env:"PAYLOAD_SCHEMA_FILE"`
+	Message     string `yaml:"message" env:"PAYLOAD_MESSAGE"`
+	Batch       string `yaml:"batch" env:"PAYLOAD_BATCH"`
+	IndexColumn string `yaml:"index_column" env:"PAYLOAD_INDEX_COLUMN"`
+}
+
+// FilterConfig configures which messages are inserted, dropped, or dead-lettered.
+// Rules are in selector=pattern:action format, the default action applies when none matches
+type FilterConfig struct {
+	Rules   []string `yaml:"rules" env:"FILTER_RULES"`
+	Default string   `yaml:"default" env:"FILTER_DEFAULT"`
+}
+
+// TransformConfig configures reshaping of records before they are written.
+// Rename maps source dotted paths to target ones, defaults are only set when
+// the field is missing or null while constants always overwrite it
+type TransformConfig struct {
+	Rename           map[string]string      `yaml:"rename" env:"TRANSFORM_RENAME"`
+	Drop             []string               `yaml:"drop" env:"TRANSFORM_DROP"`
+	Flatten          []string               `yaml:"flatten" env:"TRANSFORM_FLATTEN"`
+	FlattenSeparator string                 `yaml:"flatten_separator" env:"TRANSFORM_FLATTEN_SEPARATOR"`
+	Defaults         map[string]interface{} `yaml:"defaults" env:"TRANSFORM_DEFAULTS"`
+	Constants        map[string]interface{} `yaml:"constants" env:"TRANSFORM_CONSTANTS"`
+	Cast             map[string]string      `yaml:"cast" env:"TRANSFORM_CAST"`
+}
+
+// ScriptConfig configures the Starlark script run on each record after the transform,
+// timeout is in milliseconds and applies to each call
+type ScriptConfig struct {
+	File     string `yaml:"file" env:"SCRIPT_FILE"`
+	Function string `yaml:"function" env:"SCRIPT_FUNCTION"`
+	Timeout  int    `yaml:"timeout_ms" env:"SCRIPT_TIMEOUT_MS"`
+}
+
+// MetadataConfig configures message metadata columns added to each record,
+// attributes are either JSON object string or repeated key/value record
+type MetadataConfig struct {
+	Columns    []string `yaml:"columns" env:"METADATA_COLUMNS"`
+	Prefix     string   `yaml:"prefix" env:"METADATA_PREFIX"`
+	Attributes string   `yaml:"attributes" env:"METADATA_ATTRIBUTES"`
+}
+
+// SinkConfig configures where records are written
+type SinkConfig struct {
+	Type          string `yaml:"type" env:"SINK"`
+	StorageStream string `yaml:"storage_stream" env:"STORAGE_STREAM"`
+	LoadStaging   string `yaml:"load_staging" env:"LOAD_STAGING"`
+}
+
+// SchemaConfig configures schema coercion and evolution
+type SchemaConfig struct {
+	Coerce      bool     `yaml:"coerce" env:"COERCE_SCHEMA"`
+	Evolve      string   `yaml:"evolve" env:"EVOLVE_SCHEMA"`
+	EvolveAllow []string `yaml:"evolve_allow" env:"EVOLVE_ALLOW"`
+	EvolveDeny  []string `yaml:"evolve_deny" env:"EVOLVE_DENY"`
+}
+
+// TableConfig configures creation of missing tables
+type TableConfig struct {
+	Enabled   bool `yaml:"enabled" env:"CREATE_TABLE"`
+	TableSpec `yaml:",inline"`
+}
+
+// RoutingConfig configures routing of records into multiple tables
+type RoutingConfig struct {
+	Mode     string   `yaml:"mode" env:"TABLE_ROUTING"`
+	Field    string   `yaml:"field" env:"ROUTING_FIELD"`
+	Template string   `yaml:"template" env:"ROUTING_TEMPLATE"`
+	Rules    []string `yaml:"rules" env:"ROUTING_RULES"`
+}
+
+// InsertIDConfig configures how BigQuery insert IDs are derived
+type InsertIDConfig struct {
+	Mode string `yaml:"mode" env:"INSERT_ID_MODE"`
+	Key  string `yaml:"key" env:"INSERT_ID_KEY"`
+}
+
+// DeadLetterConfig configures where rejected messages go
+type DeadLetterConfig struct {
+	Type   string `yaml:"type" env:"DEAD_LETTER_TYPE"`
+	Target string `yaml:"target" env:"DEAD_LETTER_TARGET"`
+}
+
+// defaultConfig returns config with default settings
+func defaultConfig() *Config {
+	return &Config{
+		Port:        "8080",
+		Release:     "v0.0.1-default",
+		BatchSize:   100,
+		MaxStall:    30,
+		MaxDuration: 900,
+		Source:      SourceConfig{Type: sourceTypePubSub},
+		Push:        PushConfig{FlushInterval: 1000},
+		Compression: CompressionConfig{Attribute: "content-encoding", Detect: true, MaxSize: 10 << 20},
+		CloudEvents: CloudEventsConfig{Prefix: "ce_"},
+		Payload: PayloadConfig{
+			Format:      payloadFormatJSON,
+			Column:      "payload",
+			Type:        rawTypeString,
+			Encoding:    encodingBinary,
+			IndexColumn: "_index",
+		},
+		Filter:      FilterConfig{Default: filterActionInsert},
+		Transform:   TransformConfig{FlattenSeparator: "_"},
+		Script:      ScriptConfig{Function: "transform", Timeout: 1000},
+		Metadata:    MetadataConfig{Prefix: "_", Attributes: attributesFormatJSON},
+		Sink:        SinkConfig{Type: sinkTypeBigQuery, StorageStream: storageStreamCommitted},
+		Schema:      SchemaConfig{Coerce: true, Evolve: evolveModeOff},
+		CreateTable: TableConfig{TableSpec: TableSpec{SampleSize: 100}},
+		Routing:     RoutingConfig{Mode: routingNone},
+		InsertID:    InsertIDConfig{Mode: insertIDModeMessage},
+		DeadLetter:  DeadLetterConfig{Type: deadLetterTypeNack},
+	}
+}
+
+// LoadConfig reads config file (local path or gs://bucket/object) when path is set,
+// applies env var overrides, and fills in pipeline defaults. Config is not validated,
+// env vars which could not be applied are reported by Validate along with the other problems
+func LoadConfig(ctx context.Context, path string) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		b, err := readFile(ctx, path)
+		if err != nil {
+			return nil, fmt.Errorf("config file[%s]: %v", path, err)
+		}
+		if err := yaml.UnmarshalStrict(b, c); err != nil {
+			return nil, fmt.Errorf("config file[%s] parse: %v", path, err)
+		}
+	}
+	c.envErrors = applyEnv(reflect.ValueOf(c).Elem())
+
+	if len(c.Pipelines) == 0 {
+		c.Pipelines = []*Pipeline{{
+			Subscription: c.Subscription,
+			Dataset:      c.Dataset,
+			Table:        c.Table,
+		}}
+	}
+	for _, p := range c.Pipelines {
+		if p.Name == "" {
+			p.Name = p.Subscription
+		}
+		if p.Dataset == "" {
+			p.Dataset = c.Dataset
+		}
+		if p.BatchSize == 0 {
+			p.BatchSize = c.BatchSize
+		}
+		if p.MaxStall == 0 {
+			p.MaxStall = c.MaxStall
+		}
+		if p.MaxDuration == 0 {
+			p.MaxDuration = c.MaxDuration
+		}
+		if p.Payload == nil {
+			payload := c.Payload
+			p.Payload = &payload
+		} else {
+			p.Payload.fillDefaults()
+		}
+	}
+
+	// partition decorators need partitioned table
+	if c.CreateTable.PartitionType == "" && c.Routing.Mode == routingPartition {
+		c.CreateTable.PartitionType = string(bigquery.DayPartitioningType)
+	}
+	// events are routed by their type column
+	if c.Routing.Field == "" && c.Routing.Mode == routingEventType {
+		c.Routing.Field = c.CloudEvents.Prefix + eventType
+	}
+	return c, nil
+}
+
+// fillDefaults sets the defaults of pipeline payload settings left unset
+func (c *PayloadConfig) fillDefaults() {
+	d := defaultConfig().Payload
+	if c.Format == "" {
+		c.Format = d.Format
+	}
+	if c.Column == "" {
+		c.Column = d.Column
+	}
+	if c.Type == "" {
+		c.Type = d.Type
+	}
+	if c.Encoding == "" {
+		c.Encoding = d.Encoding
+	}
+	if c.IndexColumn == "" {
+		c.IndexColumn = d.IndexColumn
+	}
+}
+
+// applyEnv overrides fields tagged with env with the first of their env vars which is set,
+// empty env vars are treated as not set so scripts can pass all of them.
+// All env vars which could not be applied are returned
+func applyEnv(v reflect.Value) []error {
+	errs := make([]error, 0)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f, fv := t.Field(i), v.Field(i)
+		tag := f.Tag.Get("env")
+		if tag == "" {
+			if fv.Kind() == reflect.Struct {
+				errs = append(errs, applyEnv(fv)...)
+			}
+			continue
+		}
+		for _, name := range strings.Split(tag, ",") {
+			val := strings.TrimSpace(os.Getenv(name))
+			if val == "" {
+				continue
+			}
+			if err := setField(fv, val); err != nil {
+				errs = append(errs, fmt.Errorf("env var %s: %v", name, err))
+			}
+			break
+		}
+	}
+	return errs
+}
+
+// setField sets string, int, bool, list, or key=value list map field from env var value
+func setField(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid number: %q", s)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean: %q", s)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		v.Set(reflect.ValueOf(parseList(s)))
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for _, item := range parseList(s) {
+			parts := strings.SplitN(item, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				return fmt.Errorf("invalid item, expected key=value: %q", item)
+			}
+			val := reflect.ValueOf(strings.TrimSpace(parts[1]))
+			m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(parts[0])), val.Convert(v.Type().Elem()))
+		}
+		v.Set(m)
+	default:
+		return fmt.Errorf("unsupported type: %s", v.Kind())
+	}
+	return nil
+}
+
+// parseList splits comma or semicolon separated list skipping empty items.
+// Semicolons are needed where commas already separate the values, e.g. in Cloud Run env vars
+func parseList(s string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Validate checks the config and returns all problems found
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+	errs = append(errs, c.envErrors...)
+
+	// token authenticates drain notifications and push deliveries without OIDC,
+	// push-only service with OIDC doesn't need it and has the notification endpoint disabled
+	if c.Token == "" && c.Push.Audience == "" {
+		add("token required (TOKEN) unless push deliveries use OIDC (PUSH_AUDIENCE)")
+	}
+
+	subs := make(map[string]bool, len(c.Pipelines))
+	for i, p := range c.Pipelines {
+		name := p.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		if p.Subscription == "" {
+			add("pipeline %s: subscription required (SUB)", name)
+		} else if subs[p.Subscription] {
+			add("pipeline %s: duplicate subscription %s", name, p.Subscription)
+		}
+		subs[p.Subscription] = true
+		if p.Dataset == "" {
+			add("pipeline %s: dataset required (DATASET)", name)
+		}
+		if p.Table == "" {
+			add("pipeline %s: table required (TABLE)", name)
+		}
+		if p.BatchSize <= 0 {
+			add("pipeline %s: batch size must be positive, got %d", name, p.BatchSize)
+		}
+		if p.MaxStall <= 0 {
+			add("pipeline %s: max stall must be positive, got %d", name, p.MaxStall)
+		}
+		if p.MaxDuration <= p.MaxStall {
+			add("pipeline %s: max duration (%d) must be greater than max stall (%d)",
+				name, p.MaxDuration, p.MaxStall)
+		}
+		if p.Payload == nil {
+			add("pipeline %s: payload required", name)
+		} else if _, err := NewPayloadDecoder(context.Background(), *p.Payload); err != nil {
+			add("pipeline %s: payload: %v", name, err)
+		}
+	}
+
+	switch c.Source.Type {
+	case sourceTypePubSub:
+	case sourceTypeFile:
+		if c.Source.File == "" {
+			add("source file required for %s source (SOURCE_FILE)", c.Source.Type)
+		}
+	default:
+		add("invalid source type: %s", c.Source.Type)
+	}
+
+	// load sink holds pushed messages until the pipeline stops, longer than pubsub waits for them
+	if c.Push.Audience != "" && c.Sink.Type == sinkTypeLoad {
+		add("%s sink does not support push delivery (PUSH_AUDIENCE)", c.Sink.Type)
+	}
+	if c.Push.FlushInterval <= 0 {
+		add("push flush interval must be positive, got %d", c.Push.FlushInterval)
+	}
+
+	if _, err := NewDecompressor(c.Compression); err != nil {
+		add("compression: %v", err)
+	}
+	if _, err := NewCloudEvents(c.CloudEvents); err != nil {
+		add("cloudevents: %v", err)
+	}
+	if _, err := NewFilter(c.Filter); err != nil {
+		add("filter: %v", err)
+	}
+	if _, err := NewTransformer(c.Transform); err != nil {
+		add("transform: %v", err)
+	}
+	if _, err := NewMetadata(c.Metadata, ""); err != nil {
+		add("metadata: %v", err)
+	}
+	if _, err := NewScript(context.Background(), c.Script); err != nil {
+		add("script: %v", err)
+	}
+
+	switch c.Sink.Type {
+	case sinkTypeBigQuery, sinkTypeMemory:
+	case sinkTypeStorage:
+		if c.Sink.StorageStream != storageStreamCommitted && c.Sink.StorageStream != storageStreamPending {
+			add("invalid storage stream type: %s", c.Sink.StorageStream)
+		}
+	case sinkTypeLoad:
+		if c.Sink.LoadStaging == "" {
+			add("staging location required for %s sink (LOAD_STAGING)", c.Sink.Type)
+		}
+	default:
+		add("invalid sink type: %s", c.Sink.Type)
+	}
+
+	switch c.Schema.Evolve {
+	case evolveModeOff:
+	case evolveModeOn, evolveModeDryRun:
+		if !c.Schema.Coerce {
+			add("schema evolution requires schema coercion (COERCE_SCHEMA)")
+		}
+	default:
+		add("invalid schema evolution mode: %s", c.Schema.Evolve)
+	}
+
+	if c.CreateTable.Enabled {
+		if _, ok := partitionFormats[bigquery.TimePartitioningType(strings.ToUpper(c.CreateTable.PartitionType))]; !ok && c.CreateTable.PartitionType != "" {
+			add("invalid partition type: %s", c.CreateTable.PartitionType)
+		}
+		if c.CreateTable.SchemaFile == "" {
+			if c.CreateTable.SampleSize <= 0 {
+				add("schema sample size must be positive, got %d", c.CreateTable.SampleSize)
+			}
+			if c.Sink.Type == sinkTypeStorage {
+				add("%s sink requires table schema file to create table (TABLE_SCHEMA_FILE)", c.Sink.Type)
+			}
+			if c.Routing.Mode == routingTemplate || c.Routing.Mode == routingRules || c.Routing.Mode == routingEventType {
+				add("%s routing requires table schema file to create table (TABLE_SCHEMA_FILE)", c.Routing.Mode)
+			}
+		}
+	}
+
+	if _, err := NewTableRouter(c.Routing, "table", c.CreateTable.PartitionType); err != nil {
+		add("%v", err)
+	}
+	if c.Routing.Mode == routingEventType && !c.CloudEvents.Enabled {
+		add("%s routing requires cloudevents mode (CLOUDEVENTS)", c.Routing.Mode)
+	}
+	if c.Routing.Mode == routingPartition && c.Sink.Type == sinkTypeStorage {
+		add("%s sink does not support partition routing", c.Sink.Type)
+	}
+
+	switch c.InsertID.Mode {
+	case insertIDModeMessage, insertIDModeRandom, insertIDModeNone:
+	case insertIDModeField, insertIDModeAttribute:
+		if c.InsertID.Key == "" {
+			add("insert ID key required for %s mode (INSERT_ID_KEY)", c.InsertID.Mode)
+		}
+	default:
+		add("invalid insert ID mode: %s", c.InsertID.Mode)
+	}
+
+	switch c.DeadLetter.Type {
+	case deadLetterTypeNack, deadLetterTypeLog:
+	case deadLetterTypePubSub, deadLetterTypeFile:
+		if c.DeadLetter.Target == "" {
+			add("dead-letter target required for %s dead-letter (DEAD_LETTER_TARGET)", c.DeadLetter.Type)
+		}
+	case deadLetterTypeBigQuery:
+		if _, _, err := parseTableName(c.DeadLetter.Target); err != nil {
+			add("dead-letter target: %v", err)
+		}
+	default:
+		add("invalid dead-letter type: %s", c.DeadLetter.Type)
+	}
+
+	return errs
+}
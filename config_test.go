@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigEnvProblems(t *testing.T) {
+	t.Setenv("DEBUG", "2")
+	t.Setenv("BATCH_SIZE", "many")
+	t.Setenv("MAX_STALL", "long")
+	t.Setenv("COERCE_SCHEMA", "maybe")
+
+	c, err := LoadConfig(context.Background(), "")
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	if c.Debug != 2 {
+		t.Errorf("got debug %d, want 2", c.Debug)
+	}
+	// all env vars which could not be applied are reported
+	problems := make([]string, 0)
+	for _, err := range c.Validate() {
+		problems = append(problems, err.Error())
+	}
+	all := strings.Join(problems, "\n")
+	for _, name := range []string{"BATCH_SIZE", "MAX_STALL", "COERCE_SCHEMA"} {
+		if !strings.Contains(all, "env var "+name) {
+			t.Errorf("problem with %s not reported in:\n%s", name, all)
+		}
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	tokenRequired := func(c *Config) bool {
+		for _, err := range c.Validate() {
+			if strings.HasPrefix(err.Error(), "token required") {
+				return true
+			}
+		}
+		return false
+	}
+	c, err := LoadConfig(context.Background(), "")
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	c.Token = ""
+	if !tokenRequired(c) {
+		t.Errorf("token not required for drain notifications")
+	}
+	c.Push.Audience = "https://pump.example.com/v1/push"
+	if tokenRequired(c) {
+		t.Errorf("token required for push with OIDC")
+	}
+}
+
+func TestValidatePushSink(t *testing.T) {
+	c, err := LoadConfig(context.Background(), "")
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	c.Push.Audience = "https://pump.example.com/v1/push"
+	c.Sink.Type = sinkTypeLoad
+	c.Sink.LoadStaging = "gs://bucket/staging"
+	found := false
+	for _, err := range c.Validate() {
+		found = found || strings.Contains(err.Error(), "does not support push delivery")
+	}
+	if !found {
+		t.Errorf("push delivery not rejected for %s sink", c.Sink.Type)
+	}
+}
+
+func TestValidateInsertID(t *testing.T) {
+	for _, c := range []InsertIDConfig{
+		{Mode: insertIDModeField},
+		{Mode: insertIDModeAttribute},
+		{Mode: "hash"},
+	} {
+		conf, err := LoadConfig(context.Background(), "")
+		if err != nil {
+			t.Fatalf("error loading config: %v", err)
+		}
+		conf.InsertID = c
+		found := false
+		for _, err := range conf.Validate() {
+			found = found || strings.Contains(err.Error(), "insert ID")
+		}
+		if !found {
+			t.Errorf("insert ID config %+v not rejected", c)
+		}
+	}
+}
+
+func TestLoadConfigPipelines(t *testing.T) {
+	path := writeTestFile(t, "config.yaml", `
+dataset: ds
+batch_size: 50
+payload:
+  format: raw
+pipelines:
+  - subscription: orders
+    table: orders
+  - name: clicks
+    subscription: clicks-sub
+    dataset: web
+    table: clicks
+    batch_size: 500
+`)
+	c, err := LoadConfig(context.Background(), path)
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	if len(c.Pipelines) != 2 {
+		t.Fatalf("got %d pipelines, want 2", len(c.Pipelines))
+	}
+	// unset pipeline settings default to the top level ones
+	orders := findPipeline(c.Pipelines, "orders")
+	if orders == nil || orders.Name != "orders" || orders.Dataset != "ds" || orders.BatchSize != 50 ||
+		orders.Payload.Format != payloadFormatRaw {
+		t.Errorf("got orders pipeline %+v, want defaults of the top level", orders)
+	}
+	clicks := findPipeline(c.Pipelines, "clicks-sub")
+	if clicks == nil || clicks.Name != "clicks" || clicks.Dataset != "web" || clicks.BatchSize != 500 {
+		t.Errorf("got clicks pipeline %+v, want its own settings", clicks)
+	}
+	if p := findPipeline(c.Pipelines, "other"); p != nil {
+		t.Errorf("got pipeline %s for unknown subscription", p.Name)
+	}
+
+	c.Pipelines[1].Subscription = "orders"
+	found := false
+	for _, err := range c.Validate() {
+		found = found || strings.Contains(err.Error(), "duplicate subscription")
+	}
+	if !found {
+		t.Errorf("duplicate subscription not rejected")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	// dead-letter types
+	deadLetterTypeNack     = "nack"
+	deadLetterTypeLog      = "log"
+	deadLetterTypePubSub   = "pubsub"
+	deadLetterTypeBigQuery = "bigquery"
+	deadLetterTypeFile     = "file"
+
+	// attributes added to messages republished to dead-letter topic
+	deadLetterReasonAttr    = "dead_letter_reason"
+	deadLetterMessageIDAttr = "dead_letter_message_id"
+)
+
+// DeadLetter receives messages which could not be inserted into BigQuery
+type DeadLetter interface {
+	Send(ctx context.Context, msg *Message, reason string) error
+	Close() error
+}
+
+// redeliverDeadLetter is implemented by dead-letters which leave rejected messages
+// for pubsub to redeliver rather than acking them once sent
+type redeliverDeadLetter interface {
+	Redeliver() bool
+}
+
+// redeliverRejected checks whether rejected messages should be nacked instead of acked
+func redeliverRejected(d DeadLetter) bool {
+	rd, ok := d.(redeliverDeadLetter)
+	return ok && rd.Redeliver()
+}
+
+// NewDeadLetter creates dead-letter of the provided type.
+// Target is topic name for pubsub, dataset.table for bigquery, and file path for file
+func NewDeadLetter(ctx context.Context, dlType, target string) (d DeadLetter, err error) {
+	switch dlType {
+	case "", deadLetterTypeNack:
+		return &nackDeadLetter{}, nil
+	case deadLetterTypeLog:
+		return &logDeadLetter{}, nil
+	case deadLetterTypePubSub:
+		return newPubSubDeadLetter(ctx, target)
+	case deadLetterTypeBigQuery:
+		return newBigQueryDeadLetter(ctx, target)
+	case deadLetterTypeFile:
+		return newFileDeadLetter(target)
+	default:
+		return nil, fmt.Errorf("invalid dead-letter type: %s", dlType)
+	}
+}
+
+// deadLetterRecord is the failed message along with the reason it failed
+type deadLetterRecord struct {
+	MessageID   string            `json:"message_id"`
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	PublishTime time.Time         `json:"publish_time"`
+	Reason      string            `json:"reason"`
+	FailedAt    time.Time         `json:"failed_at"`
+}
+
+func newDeadLetterRecord(msg *Message, reason string) *deadLetterRecord {
+	return &deadLetterRecord{
+		MessageID:   msg.ID,
+		Data:        msg.Data,
+		Attributes:  msg.Attributes,
+		PublishTime: msg.PublishTime,
+		Reason:      reason,
+		FailedAt:    time.Now().UTC(),
+	}
+}
+
+// Save implements bigquery.ValueSaver, attributes are saved as JSON string
+func (r *deadLetterRecord) Save() (map[string]bigquery.Value, string, error) {
+	attrs, err := json.Marshal(r.Attributes)
+	if err != nil {
+		return nil, "", err
+	}
+	return map[string]bigquery.Value{
+		"message_id":   r.MessageID,
+		"data":         r.Data,
+		"attributes":   string(attrs),
+		"publish_time": r.PublishTime,
+		"reason":       r.Reason,
+		"failed_at":    r.FailedAt,
+	}, r.MessageID, nil
+}
+
+// nackDeadLetter logs the rejected message and leaves it for redelivery,
+// subscription's dead-letter policy then decides when to stop redelivering it
+type nackDeadLetter struct{}
+
+func (d *nackDeadLetter) Send(ctx context.Context, msg *Message, reason string) error {
+	logger.Printf("rejected[%s], message will be redelivered: %s", msg.ID, reason)
+	return nil
+}
+
+func (d *nackDeadLetter) Redeliver() bool {
+	return true
+}
+
+func (d *nackDeadLetter) Close() error {
+	return nil
+}
+
+// logDeadLetter simply logs the rejected message along with the reason
+type logDeadLetter struct{}
+
+func (d *logDeadLetter) Send(ctx context.Context, msg *Message, reason string) error {
+	logger.Printf("dead-letter[%s]: %s - %q", msg.ID, reason, msg.Data)
+	return nil
+}
+
+func (d *logDeadLetter) Close() error {
+	return nil
+}
+
+// pubSubDeadLetter republishes the original message to a topic
+// with the reason and original message ID added to its attributes
+type pubSubDeadLetter struct {
+	client *pubsub.Client
+	topic  *pubsub.Topic
+}
+
+func newPubSubDeadLetter(ctx context.Context, topic string) (*pubSubDeadLetter, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("dead-letter topic name required")
+	}
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub client[%s]: %v", projectID, err)
+	}
+	return &pubSubDeadLetter{
+		client: client,
+		topic:  client.Topic(topic),
+	}, nil
+}
+
+func (d *pubSubDeadLetter) Send(ctx context.Context, msg *Message, reason string) error {
+	attrs := make(map[string]string, len(msg.Attributes)+2)
+	for k, v := range msg.Attributes {
+		attrs[k] = v
+	}
+	attrs[deadLetterReasonAttr] = reason
+	attrs[deadLetterMessageIDAttr] = msg.ID
+
+	res := d.topic.Publish(ctx, &pubsub.Message{
+		Data:       msg.Data,
+		Attributes: attrs,
+	})
+	if _, err := res.Get(ctx); err != nil {
+		return fmt.Errorf("dead-letter publish[%s]: %v", d.topic.ID(), err)
+	}
+	return nil
+}
+
+func (d *pubSubDeadLetter) Close() error {
+	d.topic.Stop()
+	return d.client.Close()
+}
+
+// bigQueryDeadLetter inserts failed messages into an error table with
+// message_id, data (BYTES), attributes (STRING), publish_time, reason, failed_at columns
+type bigQueryDeadLetter struct {
+	client   *bigquery.Client
+	inserter *bigquery.Inserter
+}
+
+func newBigQueryDeadLetter(ctx context.Context, target string) (*bigQueryDeadLetter, error) {
+	ds, table, err := parseTableName(target)
+	if err != nil {
+		return nil, err
+	}
+	client, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("bigquery client[%s]: %v", projectID, err)
+	}
+	return &bigQueryDeadLetter{
+		client:   client,
+		inserter: client.Dataset(ds).Table(table).Inserter(),
+	}, nil
+}
+
+func (d *bigQueryDeadLetter) Send(ctx context.Context, msg *Message, reason string) error {
+	if err := d.inserter.Put(ctx, newDeadLetterRecord(msg, reason)); err != nil {
+		return fmt.Errorf("dead-letter insert[%s]: %v", msg.ID, err)
+	}
+	return nil
+}
+
+func (d *bigQueryDeadLetter) Close() error {
+	return d.client.Close()
+}
+
+// fileDeadLetter appends failed messages as newline-delimited JSON to a local file
+type fileDeadLetter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileDeadLetter(path string) (*fileDeadLetter, error) {
+	if path == "" {
+		return nil, fmt.Errorf("dead-letter file path required")
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("dead-letter file[%s]: %v", path, err)
+	}
+	return &fileDeadLetter{file: f}, nil
+}
+
+func (d *fileDeadLetter) Send(ctx context.Context, msg *Message, reason string) error {
+	b, err := json.Marshal(newDeadLetterRecord(msg, reason))
+	if err != nil {
+		return fmt.Errorf("dead-letter marshal[%s]: %v", msg.ID, err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("dead-letter write[%s]: %v", d.file.Name(), err)
+	}
+	return nil
+}
+
+func (d *fileDeadLetter) Close() error {
+	return d.file.Close()
+}
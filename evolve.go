@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	// schema evolution modes
+	evolveModeOff    = "off"
+	evolveModeOn     = "on"
+	evolveModeDryRun = "dry-run"
+
+	// backoff of schema update after it failed
+	evolveRetryMin = 30 * time.Second
+	evolveRetryMax = 10 * time.Minute
+)
+
+// SchemaEvolver adds columns for record fields which are not yet in the table schema.
+// Columns of all new fields of a batch are added in single table update before it's inserted.
+// Only nullable and repeated columns are ever added, existing columns are never changed.
+// In dry-run mode the columns are only reported
+type SchemaEvolver struct {
+	mu      sync.Mutex
+	client  *bigquery.Client
+	table   *bigquery.Table
+	conv    *SchemaConverter
+	dryRun  bool
+	allow   []string
+	deny    []string
+	added   map[string]string
+	pending map[string]string
+	base    bigquery.Schema
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// NewSchemaEvolver creates evolver for ds.table which updates the converter schema as columns are added.
+// Allow and deny are lists of dotted field path patterns, empty allow list allows all fields
+func NewSchemaEvolver(ctx context.Context, ds, table, mode string, allow, deny []string, conv *SchemaConverter) (*SchemaEvolver, error) {
+	if mode != evolveModeOn && mode != evolveModeDryRun {
+		return nil, fmt.Errorf("invalid schema evolution mode: %s", mode)
+	}
+	client, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("bigquery client[%s]: %v", projectID, err)
+	}
+	return &SchemaEvolver{
+		client:  client,
+		table:   client.Dataset(ds).Table(table),
+		conv:    conv,
+		dryRun:  mode == evolveModeDryRun,
+		allow:   allow,
+		deny:    deny,
+		added:   make(map[string]string),
+		pending: make(map[string]string),
+	}, nil
+}
+
+// Evolve extends the converter schema with columns for the new fields in record before it's
+// converted, so the fields are kept until Apply adds the columns. While the failed update
+// backs off, new fields are dropped by the converter
+func (e *SchemaEvolver) Evolve(rec simpleRecord) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Now().Before(e.retryAt) {
+		return
+	}
+
+	m := make(map[string]interface{}, len(rec))
+	for k, v := range rec {
+		m[k] = v
+	}
+	schema, added := extendSchema(e.conv.Schema(), m, "", e.allowed)
+	if len(added) == 0 {
+		return
+	}
+
+	if e.dryRun {
+		for p, t := range added {
+			if _, ok := e.added[p]; !ok {
+				logger.Printf("dry-run: would add column %s (%s)", p, t)
+				e.added[p] = t
+			}
+		}
+		return
+	}
+
+	if len(e.pending) == 0 {
+		e.base = e.conv.Schema()
+	}
+	for p, t := range added {
+		e.pending[p] = t
+	}
+	e.conv.SetSchema(schema)
+}
+
+// Apply adds columns for all new fields seen since it was last called in single table update.
+// When the update fails the converter goes back to the table schema and evolution backs off
+func (e *SchemaEvolver) Apply(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.pending) == 0 {
+		return nil
+	}
+	pending := len(e.pending)
+	e.pending = make(map[string]string)
+
+	if err := e.update(ctx); err != nil {
+		e.conv.SetSchema(e.base)
+		e.backoff *= 2
+		if e.backoff < evolveRetryMin {
+			e.backoff = evolveRetryMin
+		}
+		if e.backoff > evolveRetryMax {
+			e.backoff = evolveRetryMax
+		}
+		e.retryAt = time.Now().Add(e.backoff)
+		return fmt.Errorf("adding %d columns, retry in %v: %v", pending, e.backoff, err)
+	}
+	e.backoff = 0
+	return nil
+}
+
+// update adds the columns the converter schema has to the table schema
+func (e *SchemaEvolver) update(ctx context.Context) error {
+	// extend the latest table schema in case it changed since it was fetched
+	meta, err := e.table.Metadata(ctx)
+	if err != nil {
+		return fmt.Errorf("table metadata: %v", err)
+	}
+	schema, added := mergeSchema(meta.Schema, e.conv.Schema(), "")
+	if len(added) > 0 {
+		meta, err = e.table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: schema}, meta.ETag)
+		if err != nil {
+			return fmt.Errorf("table schema update: %v", err)
+		}
+		for p, t := range added {
+			logger.Printf("added column %s (%s)", p, t)
+			e.added[p] = t
+		}
+	}
+	e.conv.SetSchema(meta.Schema)
+	return nil
+}
+
+// Added returns columns added (or in dry-run proposed) so far along with their types
+func (e *SchemaEvolver) Added() map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	a := make(map[string]string, len(e.added))
+	for k, v := range e.added {
+		a[k] = v
+	}
+	return a
+}
+
+func (e *SchemaEvolver) Close() error {
+	return e.client.Close()
+}
+
+// extendSchema returns copy of schema with inferred columns for allowed new fields in rec
+// along with the dotted paths and types of these columns
+func extendSchema(schema bigquery.Schema, rec map[string]interface{}, prefix string, allowed func(path string) bool) (bigquery.Schema, map[string]string) {
+	out := make(bigquery.Schema, 0, len(schema))
+	index := make(map[string]int, len(schema))
+	for i, f := range schema {
+		out = append(out, f)
+		index[strings.ToLower(f.Name)] = i
+	}
+
+	added := make(map[string]string)
+	for k, v := range rec {
+		p := prefix + k
+		if i, ok := index[strings.ToLower(k)]; ok {
+			f := out[i]
+			if normalizeFieldType(f.Type) != bigquery.RecordFieldType {
+				continue
+			}
+			nested := nestedRecord(v)
+			if nested == nil {
+				continue
+			}
+			sub, subAdded := extendSchema(f.Schema, nested, p+".", allowed)
+			if len(subAdded) == 0 {
+				continue
+			}
+			nf := *f
+			nf.Schema = sub
+			out[i] = &nf
+			for sp, st := range subAdded {
+				added[sp] = st
+			}
+			continue
+		}
+
+		if allowed != nil && !allowed(p) {
+			continue
+		}
+		f := inferField(k, v)
+		if f == nil {
+			continue
+		}
+		index[strings.ToLower(k)] = len(out)
+		out = append(out, f)
+		for sp, st := range fieldPaths(f, p) {
+			added[sp] = st
+		}
+	}
+	return out, added
+}
+
+// mergeSchema returns copy of schema with the fields of extra it doesn't have
+// along with the dotted paths and types of the added columns
+func mergeSchema(schema, extra bigquery.Schema, prefix string) (bigquery.Schema, map[string]string) {
+	out := make(bigquery.Schema, 0, len(schema))
+	index := make(map[string]int, len(schema))
+	for i, f := range schema {
+		out = append(out, f)
+		index[strings.ToLower(f.Name)] = i
+	}
+
+	added := make(map[string]string)
+	for _, f := range extra {
+		p := prefix + f.Name
+		i, ok := index[strings.ToLower(f.Name)]
+		if !ok {
+			index[strings.ToLower(f.Name)] = len(out)
+			out = append(out, f)
+			for sp, st := range fieldPaths(f, p) {
+				added[sp] = st
+			}
+			continue
+		}
+		if normalizeFieldType(out[i].Type) != bigquery.RecordFieldType ||
+			normalizeFieldType(f.Type) != bigquery.RecordFieldType {
+			continue
+		}
+		sub, subAdded := mergeSchema(out[i].Schema, f.Schema, p+".")
+		if len(subAdded) == 0 {
+			continue
+		}
+		nf := *out[i]
+		nf.Schema = sub
+		out[i] = &nf
+		for sp, st := range subAdded {
+			added[sp] = st
+		}
+	}
+	return out, added
+}
+
+// allowed checks dotted field path against the deny and allow patterns, deny wins
+func (e *SchemaEvolver) allowed(p string) bool {
+	p = strings.ToLower(p)
+	for _, pattern := range e.deny {
+		if ok, _ := path.Match(strings.ToLower(pattern), p); ok {
+			return false
+		}
+	}
+	if len(e.allow) == 0 {
+		return true
+	}
+	for _, pattern := range e.allow {
+		if ok, _ := path.Match(strings.ToLower(pattern), p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// nestedRecord returns the object value of record field, or first object of repeated one
+func nestedRecord(v interface{}) map[string]interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t
+	case []interface{}:
+		for _, item := range t {
+			if m, ok := item.(map[string]interface{}); ok {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// inferField infers column from JSON value, nil when type can't be inferred (e.g. null)
+func inferField(name string, v interface{}) *bigquery.FieldSchema {
+	switch t := v.(type) {
+	case []interface{}:
+		for _, item := range t {
+			if item == nil {
+				continue
+			}
+			// arrays of arrays are not supported by BigQuery
+			if _, ok := item.([]interface{}); ok {
+				return &bigquery.FieldSchema{Name: name, Type: bigquery.StringFieldType}
+			}
+			f := inferField(name, item)
+			if f == nil {
+				return nil
+			}
+			f.Repeated = true
+			return f
+		}
+		return nil
+	case map[string]interface{}:
+		sub := make(bigquery.Schema, 0, len(t))
+		for k, item := range t {
+			if f := inferField(k, item); f != nil {
+				sub = append(sub, f)
+			}
+		}
+		if len(sub) == 0 {
+			return nil
+		}
+		return &bigquery.FieldSchema{Name: name, Type: bigquery.RecordFieldType, Schema: sub}
+	case json.Number:
+		if _, err := t.Int64(); err == nil {
+			return &bigquery.FieldSchema{Name: name, Type: bigquery.IntegerFieldType}
+		}
+		return &bigquery.FieldSchema{Name: name, Type: bigquery.FloatFieldType}
+	case float64:
+		return &bigquery.FieldSchema{Name: name, Type: bigquery.FloatFieldType}
+	case bool:
+		return &bigquery.FieldSchema{Name: name, Type: bigquery.BooleanFieldType}
+	case string:
+		return &bigquery.FieldSchema{Name: name, Type: bigquery.StringFieldType}
+	default:
+		return nil
+	}
+}
+
+// fieldPaths lists dotted paths and types of the field and all its nested fields
+func fieldPaths(f *bigquery.FieldSchema, p string) map[string]string {
+	t := string(f.Type)
+	if f.Repeated {
+		t = "REPEATED " + t
+	}
+	paths := map[string]string{p: t}
+	for _, sf := range f.Schema {
+		for sp, st := range fieldPaths(sf, p+"."+sf.Name) {
+			paths[sp] = st
+		}
+	}
+	return paths
+}
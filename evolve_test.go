@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestEvolveKeepsNewFieldsUntilApply(t *testing.T) {
+	conv := NewSchemaConverter(bigquery.Schema{{Name: "id", Type: bigquery.StringFieldType}})
+	e := &SchemaEvolver{conv: conv, added: map[string]string{}, pending: map[string]string{}}
+
+	e.Evolve(simpleRecord{"id": "1", "n": json.Number("2")})
+	e.Evolve(simpleRecord{"id": "2", "user": map[string]interface{}{"name": "a"}})
+
+	paths := make([]string, 0)
+	for p := range e.pending {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	if got := strings.Join(paths, ","); got != "n,user,user.name" {
+		t.Errorf("got pending columns %s, want n,user,user.name", got)
+	}
+	rec, err := conv.Convert(simpleRecord{"id": "3", "n": json.Number("4")})
+	if err != nil {
+		t.Fatalf("error converting: %v", err)
+	}
+	if _, ok := rec["n"]; !ok {
+		t.Errorf("new field dropped before its column is added: %v", rec)
+	}
+
+	// while backing off new fields are left to the converter to drop
+	e.retryAt = time.Now().Add(time.Minute)
+	e.Evolve(simpleRecord{"other": "x"})
+	if _, ok := e.pending["other"]; ok {
+		t.Errorf("field added to pending while backing off")
+	}
+}
+
+func TestMergeSchema(t *testing.T) {
+	table := bigquery.Schema{
+		{Name: "id", Type: bigquery.StringFieldType},
+		{Name: "user", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "name", Type: bigquery.StringFieldType},
+		}},
+	}
+	extended := bigquery.Schema{
+		{Name: "ID", Type: bigquery.StringFieldType},
+		{Name: "user", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "name", Type: bigquery.StringFieldType},
+			{Name: "age", Type: bigquery.IntegerFieldType},
+		}},
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+	}
+	schema, added := mergeSchema(table, extended, "")
+	if len(schema) != 3 || len(schema[1].Schema) != 2 {
+		t.Fatalf("got merged schema of %d columns, %d user columns, want 3 and 2", len(schema), len(schema[1].Schema))
+	}
+	if len(added) != 2 || added["user.age"] != "INTEGER" || added["tags"] != "REPEATED STRING" {
+		t.Errorf("got added columns %v", added)
+	}
+	// merged schema is a copy
+	if len(table[1].Schema) != 1 {
+		t.Errorf("table schema changed")
+	}
+}
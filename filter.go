@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// filter actions
+	filterActionInsert     = "insert"
+	filterActionDrop       = "drop"
+	filterActionDeadLetter = "dead-letter"
+)
+
+// filterRule applies action to messages whose selected value matches the pattern,
+// or doesn't match it when negated. Rule without selector matches all messages
+type filterRule struct {
+	text     string
+	selector string
+	pattern  string
+	negate   bool
+	action   string
+}
+
+// Filter decides whether message is inserted, acked and dropped, or sent to dead-letter
+// using the action of the first matching rule, or the default action when none matches
+type Filter struct {
+	rules         []*filterRule
+	defaultAction string
+}
+
+// NewFilter parses rules in selector=pattern:action or selector!=pattern:action format,
+// *:action rule matches any message. Returns nil when there are no rules and messages are inserted
+func NewFilter(cfg FilterConfig) (*Filter, error) {
+	f := &Filter{rules: make([]*filterRule, 0), defaultAction: cfg.Default}
+	if err := checkFilterAction(f.defaultAction); err != nil {
+		return nil, err
+	}
+	for _, item := range cfg.Rules {
+		i := strings.LastIndex(item, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid filter rule, expected selector=pattern:action: %q", item)
+		}
+		rule := &filterRule{text: item, action: strings.TrimSpace(item[i+1:])}
+		if err := checkFilterAction(rule.action); err != nil {
+			return nil, err
+		}
+		if match := strings.TrimSpace(item[:i]); match != "*" {
+			parts := strings.SplitN(match, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid filter rule, expected selector=pattern:action: %q", item)
+			}
+			rule.selector = strings.TrimSpace(parts[0])
+			if strings.HasSuffix(rule.selector, "!") {
+				rule.negate = true
+				rule.selector = strings.TrimSpace(strings.TrimSuffix(rule.selector, "!"))
+			}
+			if rule.selector == "" {
+				return nil, fmt.Errorf("invalid filter rule, expected selector=pattern:action: %q", item)
+			}
+			rule.pattern = strings.TrimSpace(parts[1])
+			if _, err := path.Match(rule.pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid filter rule pattern: %q", item)
+			}
+		}
+		f.rules = append(f.rules, rule)
+	}
+	if len(f.rules) == 0 && f.defaultAction == filterActionInsert {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func checkFilterAction(action string) error {
+	switch action {
+	case filterActionInsert, filterActionDrop, filterActionDeadLetter:
+		return nil
+	default:
+		return fmt.Errorf("invalid filter action: %q", action)
+	}
+}
+
+// Apply returns the action for the message along with the rule which matched. Rec is nil
+// when the message data couldn't be decoded, then only attribute rules apply and the message
+// is inserted when none matches so that its decode error still reaches dead-letter
+func (f *Filter) Apply(msg *Message, rec simpleRecord) (action, rule string) {
+	for _, r := range f.rules {
+		if rec == nil && !strings.HasPrefix(r.selector, attributesSelector) {
+			continue
+		}
+		if r.matches(msg, rec) {
+			return r.action, r.text
+		}
+	}
+	if rec == nil {
+		return filterActionInsert, ""
+	}
+	return f.defaultAction, ""
+}
+
+func (r *filterRule) matches(msg *Message, rec simpleRecord) bool {
+	if r.selector == "" {
+		return true
+	}
+	matched := false
+	if v, ok := selectValue(msg, rec, r.selector); ok {
+		matched, _ = path.Match(r.pattern, v)
+	}
+	return matched != r.negate
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFilterUndecodable(t *testing.T) {
+	f, err := NewFilter(FilterConfig{
+		Default: filterActionDrop,
+		Rules: []string{
+			"attributes.type=heartbeat:drop",
+			"env!=prod:drop",
+			"*:insert",
+		},
+	})
+	if err != nil {
+		t.Fatalf("error creating filter: %v", err)
+	}
+	heartbeat := &Message{Attributes: map[string]string{"type": "heartbeat"}}
+	if action, _ := f.Apply(heartbeat, nil); action != filterActionDrop {
+		t.Errorf("got %s for undecodable heartbeat, want drop", action)
+	}
+	// negated field rule must not drop message whose fields are unknown
+	event := &Message{Attributes: map[string]string{"type": "event"}}
+	if action, rule := f.Apply(event, nil); action != filterActionInsert {
+		t.Errorf("got %s by %q for undecodable event, want insert", action, rule)
+	}
+	if action, _ := f.Apply(event, simpleRecord{"env": "test"}); action != filterActionDrop {
+		t.Errorf("got %s for test event, want drop", action)
+	}
+}
+
+func TestFilterDefaultOnly(t *testing.T) {
+	f, err := NewFilter(FilterConfig{Default: filterActionInsert})
+	if err != nil || f != nil {
+		t.Fatalf("got filter %v, error %v, want none for insert default", f, err)
+	}
+	for _, action := range []string{filterActionDrop, filterActionDeadLetter} {
+		f, err := NewFilter(FilterConfig{Default: action})
+		if err != nil {
+			t.Fatalf("error creating filter: %v", err)
+		}
+		if f == nil {
+			t.Fatalf("no filter for %s default", action)
+		}
+		if got, _ := f.Apply(&Message{}, simpleRecord{"n": 1}); got != action {
+			t.Errorf("got %s, want default %s", got, action)
+		}
+	}
+}
+
+func TestProcessUndecodableFiltered(t *testing.T) {
+	p := testPipeline(t)
+	cfg.Filter = FilterConfig{Default: filterActionInsert, Rules: []string{"env!=prod:drop"}}
+	proc, err := NewProcessor(context.Background(), p)
+	if err != nil {
+		t.Fatalf("error creating processor: %v", err)
+	}
+	_, action, _, err := proc.Process(testMessage("1", "not json"))
+	if err == nil || action == filterActionDrop {
+		t.Errorf("got action %s, error %v, want decode error", action, err)
+	}
+}
@@ -15,7 +15,7 @@ func healthHandler(c *gin.Context) {
 
 func defaultHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
-		"release":      release,
+		"release":      cfg.Release,
 		"request_on":   time.Now(),
 		"request_from": c.Request.RemoteAddr,
 	})
@@ -46,14 +46,15 @@ type Notification struct {
 
 func notifHandler(c *gin.Context) {
 
-	if debug == 1 {
+	if cfg.Debug > 0 {
 		contentBytes, _ := ioutil.ReadAll(c.Request.Body)
 		logger.Println(string(contentBytes))
 	}
 
+	// notifications are disabled without token, e.g. for push-only service
 	token := strings.TrimSpace(c.Query("token"))
-	if token != accessToken {
-		logger.Printf("invalid access token. Got:%s Want:%s", token, accessToken)
+	if cfg.Token == "" || token != cfg.Token {
+		logger.Printf("invalid access token. Got:%s Want:%s", token, cfg.Token)
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"message": "Invalid access token",
 			"status":  "Unauthorized",
@@ -72,9 +73,10 @@ func notifHandler(c *gin.Context) {
 	}
 	logger.Printf("notification: %v", notif)
 
-	if notif.Incident.Resource.Labels.SubscriptionID != subName {
-		logger.Printf("invalid subscription. Got:%s Want:%s",
-			notif.Incident.Resource.Labels.SubscriptionID, subName)
+	p := findPipeline(cfg.Pipelines, notif.Incident.Resource.Labels.SubscriptionID)
+	if p == nil {
+		logger.Printf("invalid subscription. Got:%s, no pipeline drains it",
+			notif.Incident.Resource.Labels.SubscriptionID)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"message": "Invalid incident subscriptionID",
 			"status":  "InternalServerError",
@@ -82,7 +84,7 @@ func notifHandler(c *gin.Context) {
 		return
 	}
 
-	insertedCount, err := pump()
+	result, err := pump(p, nil)
 	if err != nil {
 		logger.Printf("Error on pump exec: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -92,10 +94,107 @@ func notifHandler(c *gin.Context) {
 		return
 	}
 
-	logger.Printf("Inserted %d records", insertedCount)
+	logger.Printf("Inserted %d records into %s, rejected %d, filtered %d",
+		result.Accepted, p.Name, result.Rejected, result.Filtered)
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Success",
-		"status":  "OK",
+		"message":  "Success",
+		"status":   "OK",
+		"pipeline": p.Name,
+		"messages": result.Messages,
+		"filtered": result.Filtered,
+		"accepted": result.Accepted,
+		"rejected": result.Rejected,
+		"dropped":  result.DroppedFields,
+		"added":    result.AddedFields,
+		"tables":   result.Tables,
+	})
+}
+
+// PushEnvelope represents pubsub push delivery
+type PushEnvelope struct {
+	Message struct {
+		ID          string            `json:"messageId"`
+		Data        []byte            `json:"data"`
+		Attributes  map[string]string `json:"attributes"`
+		PublishTime time.Time         `json:"publishTime"`
+		OrderingKey string            `json:"orderingKey"`
+	} `json:"message"`
+	Subscription    string `json:"subscription"`
+	DeliveryAttempt *int   `json:"deliveryAttempt"`
+}
+
+// pushHandler inserts pushed message with micro-batch of other pushed messages and only
+// responds with success once it's inserted, so pubsub redelivers it on any other response
+func pushHandler(c *gin.Context) {
+
+	if err := verifyPush(c.Request.Context(), c.GetHeader("Authorization"), c.Query("token")); err != nil {
+		logger.Printf("invalid push request: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "Invalid push token",
+			"status":  "Unauthorized",
+		})
+		return
+	}
+
+	if cfg.Sink.Type == sinkTypeLoad {
+		logger.Printf("push delivery not supported by %s sink", cfg.Sink.Type)
+		c.JSON(http.StatusNotImplemented, gin.H{
+			"message": "Push delivery not supported by sink",
+			"status":  "NotImplemented",
+		})
+		return
+	}
+
+	var env PushEnvelope
+	if bindErr := c.BindJSON(&env); bindErr != nil {
+		logger.Printf("error binding push envelope: %v", bindErr)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid push envelope format",
+			"status":  "BadRequest",
+		})
+		return
+	}
+
+	// subscription is pushed as projects/{project}/subscriptions/{name}
+	sub := env.Subscription[strings.LastIndex(env.Subscription, "/")+1:]
+	p := findPipeline(cfg.Pipelines, sub)
+	if p == nil {
+		logger.Printf("invalid subscription. Got:%s, no pipeline drains it", env.Subscription)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Invalid push subscription",
+			"status":  "InternalServerError",
+		})
+		return
+	}
+
+	msg := &Message{
+		ID:              env.Message.ID,
+		Data:            env.Message.Data,
+		Attributes:      env.Message.Attributes,
+		PublishTime:     env.Message.PublishTime,
+		OrderingKey:     env.Message.OrderingKey,
+		DeliveryAttempt: env.DeliveryAttempt,
+	}
+	if msg.Attributes == nil {
+		msg.Attributes = make(map[string]string)
+	}
+	acked, err := pushers.Deliver(c.Request.Context(), p, msg)
+	if err != nil || !acked {
+		if err != nil {
+			logger.Printf("Error on push delivery[%s]: %v", msg.ID, err)
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"message": "Message not inserted, it will be redelivered",
+			"status":  "ServiceUnavailable",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Success",
+		"status":   "OK",
+		"pipeline": p.Name,
+		"id":       msg.ID,
 	})
 }
@@ -2,67 +2,477 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/google/uuid"
 )
 
-func NewImportClient(ctx context.Context, ds, table string) (c *ImportClient, err error) {
-	client, err := bigquery.NewClient(ctx, projectID)
-	if err != nil {
-		return nil, err
-	}
-	inserter := client.Dataset(ds).Table(table).Inserter()
-	inserter.IgnoreUnknownValues = true
+const (
+	// insert ID modes
+	insertIDModeMessage   = "message"
+	insertIDModeField     = "field"
+	insertIDModeAttribute = "attribute"
+	insertIDModeRandom    = "random"
+	insertIDModeNone      = "none"
+)
 
-	return &ImportClient{
-		inserter: inserter,
-		records:  make([]*simpleRecord, 0),
-	}, nil
+// NewImportClient creates import client writing records of the pipeline into the provided sink
+// Processor turns each message into the records to write.
+// Converter is optional, when set records are coerced into the table schema before being appended.
+// Evolver is optional too, when set new fields are added to the table schema before records are coerced.
+// Creator is only set when the table doesn't exist yet, records are then held until the table
+// is created from the schema inferred from the first records.
+// Router is optional, when set it decides the destination table of each record
+func NewImportClient(ctx context.Context, p *Pipeline, sink Sink, dl DeadLetter, proc *Processor, conv *SchemaConverter, evolver *SchemaEvolver, creator *TableCreator, router TableRouter) (c *ImportClient, err error) {
+	c = &ImportClient{
+		pipeline:       p,
+		sink:           sink,
+		deadLetter:     dl,
+		proc:           proc,
+		converter:      conv,
+		evolver:        evolver,
+		creator:        creator,
+		router:         router,
+		converters:     make(map[string]*SchemaConverter),
+		schemaFailures: make(map[string]*routeFailure),
+		messages:       make([]*Message, 0),
+	}
+	if creator != nil {
+		c.sample = make([]*Record, 0, creator.SampleSize())
+	}
+	return c, nil
 }
 
 type simpleRecord map[string]bigquery.Value
 
-func (rec simpleRecord) Save() (map[string]bigquery.Value, string, error) {
-	return rec, uuid.New().String(), nil
+// getInsertID derives record insert ID based on the configured mode, shared when all records
+// of the message get the same one. Message mode uses event ID in CloudEvents mode, it and
+// field and attribute modes fall back on message ID when the key is not set
+func getInsertID(msg *Message, rec simpleRecord) (id string, shared bool) {
+	switch cfg.InsertID.Mode {
+	case insertIDModeNone:
+		return bigquery.NoDedupeID, false
+	case insertIDModeRandom:
+		return uuid.New().String(), false
+	case insertIDModeMessage:
+		if cfg.CloudEvents.Enabled {
+			if v, ok := rec[cfg.CloudEvents.Prefix+eventID].(string); ok && v != "" {
+				return v, true
+			}
+		}
+	case insertIDModeField:
+		if v, ok := rec[cfg.InsertID.Key]; ok && v != nil {
+			return fmt.Sprint(v), false
+		}
+	case insertIDModeAttribute:
+		if v, ok := msg.Attributes[cfg.InsertID.Key]; ok && v != "" {
+			return v, true
+		}
+	}
+	return msg.ID, true
 }
 
+// ImportClient appends records to the sink and keeps the messages they came from
+// so that messages are only acked once their records have been written
 type ImportClient struct {
-	inserter *bigquery.Inserter
-	records  []*simpleRecord
+	mu         sync.Mutex
+	pipeline   *Pipeline
+	sink       Sink
+	deadLetter DeadLetter
+	proc       *Processor
+	converter  *SchemaConverter
+	evolver    *SchemaEvolver
+	creator    *TableCreator
+	router     TableRouter
+	converters map[string]*SchemaConverter
+	messages   []*Message
+
+	// schema lookups of routed tables which failed, retried after routeRetry
+	schemaFailures map[string]*routeFailure
+
+	// messages dropped or dead-lettered by the filter or skipped by the script
+	filtered int
+
+	// raw records held until the table is created, nil once it exists
+	sample         []*Record
+	sampleRejected int
+}
+
+// InsertResult holds the number of rows accepted and rejected by the sink,
+// in total and per destination table when records are routed
+type InsertResult struct {
+	Accepted int                     `json:"accepted"`
+	Rejected int                     `json:"rejected"`
+	Tables   map[string]*TableResult `json:"tables,omitempty"`
+}
+
+// TableResult holds the number of rows accepted and rejected by single table
+type TableResult struct {
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+}
+
+// count adds single row outcome to the total and to its table
+func (r *InsertResult) count(table string, accepted bool) {
+	if accepted {
+		r.Accepted++
+	} else {
+		r.Rejected++
+	}
+	if table == "" {
+		return
+	}
+	if r.Tables == nil {
+		r.Tables = make(map[string]*TableResult)
+	}
+	t, ok := r.Tables[table]
+	if !ok {
+		t = &TableResult{}
+		r.Tables[table] = t
+	}
+	if accepted {
+		t.Accepted++
+	} else {
+		t.Rejected++
+	}
+}
+
+// Append processes message into records, appends them to the sink, and returns their number.
+// Either all records of the message are appended or the error is returned
+// before any of them is, except when the sink itself fails to append
+func (c *ImportClient) Append(ctx context.Context, msg *Message) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values, action, rule, err := c.proc.Process(msg)
+	if err != nil {
+		return 0, err
+	}
+	switch action {
+	case filterActionDrop:
+		c.filtered++
+		msg.Ack()
+		return 0, nil
+	case filterActionDeadLetter:
+		c.filtered++
+		reason := "filtered by default action"
+		if rule != "" {
+			reason = fmt.Sprintf("filtered by rule %q", rule)
+		}
+		return 0, c.Reject(ctx, msg, reason)
+	}
+	if len(values) == 0 {
+		// skipped by script or empty batch, nothing to write
+		c.filtered++
+		msg.Ack()
+		return 0, nil
+	}
+
+	records := make([]*Record, 0, len(values))
+	for i, rec := range values {
+		// insert ID is derived from the raw record as the key may not be a column
+		id, shared := getInsertID(msg, rec)
+		// records of the same message need distinct IDs unless they come from the records
+		if len(values) > 1 && shared {
+			id = fmt.Sprintf("%s-%d", id, i)
+		}
+		// so is the destination table as the routing field may be converted
+		table := ""
+		if c.router != nil {
+			if table, err = c.router.Route(msg, rec); err != nil {
+				return 0, err
+			}
+		}
+		records = append(records, &Record{ID: id, Table: table, Values: rec, Msg: msg})
+	}
+
+	if c.sample != nil {
+		c.sample = append(c.sample, records...)
+		c.messages = append(c.messages, msg)
+		if len(c.sample) >= c.creator.SampleSize() {
+			// table creation is retried on insert where its error fails the whole batch
+			if err := c.createTable(ctx); err != nil {
+				logger.Printf("error creating table: %v", err)
+			}
+		}
+		return len(records), nil
+	}
+	for _, rec := range records {
+		// new fields are kept until their columns are added before the batch is inserted.
+		// Only the default table evolves, tables routed by content have schemas of their own
+		if c.evolver != nil && (c.router == nil || c.router.SchemaTable(rec.Table) == c.pipeline.Table) {
+			c.evolver.Evolve(rec.Values)
+		}
+		if err := c.convert(ctx, rec); err != nil {
+			return 0, err
+		}
+	}
+	for _, rec := range records {
+		if err := c.sink.Append(ctx, rec); err != nil {
+			return 0, err
+		}
+	}
+	c.messages = append(c.messages, msg)
+	return len(records), nil
+}
+
+// write coerces record into the table schema and appends it to the sink
+func (c *ImportClient) write(ctx context.Context, rec *Record) error {
+	if err := c.convert(ctx, rec); err != nil {
+		return err
+	}
+	if err := c.sink.Append(ctx, rec); err != nil {
+		return err
+	}
+	c.messages = append(c.messages, rec.Msg)
+	return nil
+}
+
+// convert coerces record values into the schema of its table
+func (c *ImportClient) convert(ctx context.Context, rec *Record) error {
+	conv, err := c.converterFor(ctx, rec.Table)
+	if err != nil {
+		return err
+	}
+	if conv == nil {
+		return nil
+	}
+	converted, err := conv.Convert(rec.Values)
+	if err != nil {
+		return err
+	}
+	rec.Values = converted
+	return nil
 }
 
-func (c *ImportClient) Append(data []byte) error {
-	var mu sync.Mutex
-	mu.Lock()
-	defer mu.Unlock()
-	var rec simpleRecord
-	if err := json.Unmarshal(data, &rec); err != nil {
-		logger.Printf("error unmarshalling %q\n", data)
+// converterFor returns converter of the schema records routed to table follow,
+// schemas of tables other than the default one are fetched on first use. Missing table
+// fails the message while other lookup errors are retried, failures are kept for routeRetry
+func (c *ImportClient) converterFor(ctx context.Context, table string) (*SchemaConverter, error) {
+	if c.converter == nil || c.router == nil {
+		return c.converter, nil
+	}
+	st := c.router.SchemaTable(table)
+	if st == c.pipeline.Table {
+		return c.converter, nil
+	}
+	if conv, ok := c.converters[st]; ok {
+		return conv, nil
+	}
+	if f, ok := c.schemaFailures[st]; ok && time.Since(f.at) < routeRetry {
+		return nil, f.err
+	}
+	schema, err := FetchSchema(ctx, c.pipeline.Dataset, st)
+	if err != nil {
+		// only missing table is the message's fault, anything else is retried
+		if isAPIError(err, http.StatusNotFound) {
+			err = fmt.Errorf("table[%s.%s]: %w", c.pipeline.Dataset, st, errTableNotFound)
+		} else {
+			err = &retryError{err: err}
+		}
+		c.schemaFailures[st] = &routeFailure{err: err, at: time.Now()}
+		return nil, err
+	}
+	delete(c.schemaFailures, st)
+	conv := NewSchemaConverter(schema)
+	c.converters[st] = conv
+	return conv, nil
+}
+
+// Dropped returns the number of times each unknown field was dropped,
+// fields of tables other than the default one are prefixed with their table name
+func (c *ImportClient) Dropped() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := make(map[string]int)
+	if c.converter == nil {
+		return d
+	}
+	for k, v := range c.converter.Dropped() {
+		d[k] = v
+	}
+	for table, conv := range c.converters {
+		for k, v := range conv.Dropped() {
+			d[table+":"+k] = v
+		}
+	}
+	return d
+}
+
+// Filtered returns the number of messages dropped or dead-lettered by the filter
+// or skipped by the script
+func (c *ImportClient) Filtered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.filtered
+}
+
+// createTable creates the table from the schema inferred from the held records
+// and then writes them, records which can't be written are sent to dead-letter
+func (c *ImportClient) createTable(ctx context.Context) error {
+	values := make([]simpleRecord, 0, len(c.sample))
+	for _, rec := range c.sample {
+		values = append(values, rec.Values)
+	}
+	schema, err := c.creator.Create(ctx, c.proc.WithMetadata(c.creator.Infer(values)))
+	if err != nil {
 		return err
 	}
-	c.records = append(c.records, &rec)
+	if c.converter != nil {
+		c.converter.SetSchema(schema)
+	}
+
+	sample := c.sample
+	c.sample = nil
+	c.messages = make([]*Message, 0, len(sample))
+	rejected := make(map[*Message]bool)
+	for _, rec := range sample {
+		if rejected[rec.Msg] {
+			continue
+		}
+		if err := c.write(ctx, rec); err != nil {
+			c.sampleRejected++
+			rejected[rec.Msg] = true
+			if dlErr := c.Reject(ctx, rec.Msg, err.Error()); dlErr != nil {
+				logger.Printf("error on reject[%s]: %v", rec.Msg.ID, dlErr)
+			}
+		}
+	}
 	return nil
 }
 
+// Clear nacks any messages still in the buffer so they get redelivered
 func (c *ImportClient) Clear() {
-	var mu sync.Mutex
-	mu.Lock()
-	defer mu.Unlock()
-	c.records = make([]*simpleRecord, 0)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.messages {
+		m.Nack()
+	}
+	c.reset()
 }
 
-func (c *ImportClient) Insert(ctx context.Context) error {
-	if len(c.records) == 0 {
+// Insert flushes buffered records to the sink and resets the buffer.
+// Messages of accepted records are acked, rejected records are sent to dead-letter,
+// and if the flush itself fails all messages are nacked
+func (c *ImportClient) Insert(ctx context.Context) (r *InsertResult, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r = &InsertResult{}
+	if len(c.messages) == 0 {
 		logger.Println("nothing to insert")
-		return nil
+		return r, nil
 	}
-	logger.Printf("inserting %d records...", len(c.records))
-	if err := c.inserter.Put(ctx, c.records); err != nil {
-		logger.Printf("error on put: %v", err)
+	defer c.reset()
+
+	// create the table from whatever was sampled so far
+	if c.sample != nil {
+		if err := c.createTable(ctx); err != nil {
+			logger.Printf("error creating table: %v", err)
+			for _, m := range c.messages {
+				m.Nack()
+			}
+			return r, err
+		}
+	}
+	r.Rejected = c.sampleRejected
+	c.sampleRejected = 0
+
+	// failed schema update is not the records' fault, rows with fields
+	// whose columns are missing are retried while evolution backs off
+	if c.evolver != nil {
+		if err := c.evolver.Apply(ctx); err != nil {
+			logger.Printf("error evolving schema: %v", err)
+		}
+	}
+	logger.Printf("inserting records of %d messages...", len(c.messages))
+
+	results, err := c.sink.Flush(ctx)
+	if err != nil {
+		logger.Printf("error on flush: %v", err)
+		for _, m := range c.messages {
+			m.Nack()
+		}
+		return r, err
+	}
+
+	// messages with multiple records are only acked once all of them are accepted
+	failed := make(map[*Message]bool)
+	for _, res := range results {
+		if res.Err != nil {
+			failed[res.Record.Msg] = true
+		}
+	}
+	rejected := make(map[*Message]bool)
+	for _, res := range results {
+		m := res.Record.Msg
+		if res.Err == nil {
+			if !failed[m] {
+				m.Ack()
+			}
+			r.count(res.Record.Table, true)
+			continue
+		}
+		if res.Retry {
+			m.Nack()
+			continue
+		}
+		r.count(res.Record.Table, false)
+		if rejected[m] {
+			continue
+		}
+		rejected[m] = true
+		if dlErr := c.Reject(ctx, m, res.Err.Error()); dlErr != nil {
+			logger.Printf("error on reject[%s]: %v", m.ID, dlErr)
+		}
+	}
+
+	// messages the sink reported no records of are redelivered rather than held
+	reported := make(map[*Message]bool, len(results))
+	for _, res := range results {
+		reported[res.Record.Msg] = true
+	}
+	for _, m := range c.messages {
+		if !reported[m] {
+			m.Nack()
+		}
+	}
+	logger.Printf("inserted %d records, rejected %d", r.Accepted, r.Rejected)
+
+	return r, nil
+}
+
+// Reject sends message to dead-letter and acks it so it is not redelivered.
+// If dead-letter fails, or it leaves messages for redelivery, the message is nacked instead
+func (c *ImportClient) Reject(ctx context.Context, msg *Message, reason string) error {
+	if err := c.deadLetter.Send(ctx, msg, reason); err != nil {
+		msg.Nack()
 		return err
 	}
+	if redeliverRejected(c.deadLetter) {
+		msg.Nack()
+		return nil
+	}
+	msg.Ack()
 	return nil
 }
+
+func (c *ImportClient) reset() {
+	c.messages = make([]*Message, 0)
+	if c.sample != nil {
+		c.sample = make([]*Record, 0, c.creator.SampleSize())
+	}
+	c.sampleRejected = 0
+}
+
+// parseTableName splits dataset.table into its parts
+func parseTableName(name string) (ds, table string, err error) {
+	parts := strings.Split(strings.TrimSpace(name), ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid table name, expected dataset.table: %q", name)
+	}
+	return parts[0], parts[1], nil
+}
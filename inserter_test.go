@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// silentSink accepts records without reporting any of them on flush
+type silentSink struct{}
+
+func (silentSink) Append(ctx context.Context, rec *Record) error      { return nil }
+func (silentSink) Flush(ctx context.Context) ([]*RecordResult, error) { return nil, nil }
+func (silentSink) Close() error                                       { return nil }
+
+func TestInsertNacksUnreportedMessages(t *testing.T) {
+	ctx := context.Background()
+	p := testPipeline(t)
+	dl, err := NewDeadLetter(ctx, cfg.DeadLetter.Type, cfg.DeadLetter.Target)
+	if err != nil {
+		t.Fatalf("error creating dead-letter: %v", err)
+	}
+	defer dl.Close()
+	proc, err := NewProcessor(ctx, p)
+	if err != nil {
+		t.Fatalf("error creating processor: %v", err)
+	}
+	imp, err := NewImportClient(ctx, p, silentSink{}, dl, proc, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("error creating importer: %v", err)
+	}
+
+	msg := testMessage("lost", `{"n":1}`)
+	acked, nacked := false, false
+	msg.ack = func() { acked = true }
+	msg.nack = func() { nacked = true }
+	if _, err := imp.Append(ctx, msg); err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+	if _, err := imp.Insert(ctx); err != nil {
+		t.Fatalf("error inserting: %v", err)
+	}
+	if acked || !nacked {
+		t.Errorf("got acked %v, nacked %v, want message without result nacked", acked, nacked)
+	}
+}
+
+func TestGetInsertID(t *testing.T) {
+	testPipeline(t)
+	msg := &Message{ID: "m1", Attributes: map[string]string{"key": "a1", "empty": ""}}
+
+	tests := []struct {
+		name       string
+		mode       string
+		key        string
+		cloudEvent bool
+		rec        simpleRecord
+		wantID     string
+		wantShared bool
+	}{
+		{"message", insertIDModeMessage, "", false, simpleRecord{"ce_id": "e1"}, "m1", true},
+		{"message event", insertIDModeMessage, "", true, simpleRecord{"ce_id": "e1"}, "e1", true},
+		{"message event without ID", insertIDModeMessage, "", true, simpleRecord{}, "m1", true},
+		{"field", insertIDModeField, "order", false, simpleRecord{"order": json.Number("7")}, "7", false},
+		{"field missing", insertIDModeField, "order", false, simpleRecord{}, "m1", true},
+		{"field null", insertIDModeField, "order", false, simpleRecord{"order": nil}, "m1", true},
+		{"attribute", insertIDModeAttribute, "key", false, simpleRecord{}, "a1", true},
+		{"attribute missing", insertIDModeAttribute, "other", false, simpleRecord{}, "m1", true},
+		{"attribute empty", insertIDModeAttribute, "empty", false, simpleRecord{}, "m1", true},
+		{"none", insertIDModeNone, "", false, simpleRecord{}, bigquery.NoDedupeID, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.InsertID = InsertIDConfig{Mode: tt.mode, Key: tt.key}
+			cfg.CloudEvents.Enabled = tt.cloudEvent
+			id, shared := getInsertID(msg, tt.rec)
+			if id != tt.wantID || shared != tt.wantShared {
+				t.Errorf("got %q shared %v, want %q shared %v", id, shared, tt.wantID, tt.wantShared)
+			}
+		})
+	}
+
+	// random IDs differ for each record
+	cfg.InsertID = InsertIDConfig{Mode: insertIDModeRandom}
+	first, shared := getInsertID(msg, simpleRecord{})
+	if second, _ := getInsertID(msg, simpleRecord{}); first == second || shared {
+		t.Errorf("got %q and %q shared %v, want distinct IDs", first, second, shared)
+	}
+}
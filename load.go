@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+)
+
+const (
+	gcsScheme = "gs://"
+)
+
+var (
+	// load job errors of single row report its byte offset in the file
+	rowErrorPosition = regexp.MustCompile(`row starting at position (\d+)`)
+	rowErrorFile     = regexp.MustCompile(`File: (\S+)`)
+)
+
+// Stager stores NDJSON files which are then loaded into BigQuery in a single load job
+type Stager interface {
+	Stage(ctx context.Context, name string, data []byte) (uri string, err error)
+	Source(ctx context.Context, uris []string) (bigquery.LoadSource, error)
+	Cleanup(ctx context.Context, uris []string) error
+	Close() error
+}
+
+// NewStager creates GCS stager for gs://bucket/prefix locations and local one for any other path
+func NewStager(ctx context.Context, location string) (s Stager, err error) {
+	if location == "" {
+		return nil, fmt.Errorf("staging location required")
+	}
+	if strings.HasPrefix(location, gcsScheme) {
+		return newGCSStager(ctx, location)
+	}
+	return newLocalStager(location)
+}
+
+// loadSink stages records as NDJSON files of up to batch size rows
+// and loads all of them in a single load job when flushed at the end of the drain.
+// Position of each record is kept so rows the job failed on can be rejected
+type loadSink struct {
+	mu        sync.Mutex
+	client    *bigquery.Client
+	table     *bigquery.Table
+	stager    Stager
+	chunk     int
+	run       string
+	buf       bytes.Buffer
+	rows      int
+	staged    []string
+	sizes     []int64
+	pending   []*Record
+	positions []rowPosition
+}
+
+// rowPosition is the staged file index and byte offset of record in it
+type rowPosition struct {
+	file   int
+	offset int64
+}
+
+// NewLoadSink creates load job sink for ds.table staging files of up to batch size rows in the provided location
+func NewLoadSink(ctx context.Context, ds, table, location string, batchSize int) (s Sink, err error) {
+	stager, err := NewStager(ctx, location)
+	if err != nil {
+		return nil, fmt.Errorf("stager[%s]: %v", location, err)
+	}
+	client, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		stager.Close()
+		return nil, fmt.Errorf("bigquery client[%s]: %v", projectID, err)
+	}
+	return &loadSink{
+		client:  client,
+		table:   client.Dataset(ds).Table(table),
+		stager:  stager,
+		chunk:   batchSize,
+		run:     fmt.Sprintf("%s-%s-%d", ds, table, time.Now().UnixNano()),
+		staged:  make([]string, 0),
+		sizes:   make([]int64, 0),
+		pending: make([]*Record, 0),
+	}, nil
+}
+
+// FlushOnDrain tells the pump to only flush this sink once all messages are received
+func (s *loadSink) FlushOnDrain() bool {
+	return true
+}
+
+func (s *loadSink) Append(ctx context.Context, rec *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := json.Marshal(toJSONValues(rec.Values))
+	if err != nil {
+		return err
+	}
+	// buffer is staged as the next file even when staging has to be retried
+	s.positions = append(s.positions, rowPosition{file: len(s.staged), offset: int64(s.buf.Len())})
+	s.buf.Write(b)
+	s.buf.WriteByte('\n')
+	s.rows++
+	s.pending = append(s.pending, rec)
+	// staging errors are not the record's fault, keep buffering and retry on flush
+	if s.rows >= s.chunk {
+		if err := s.stage(ctx); err != nil {
+			logger.Printf("error staging records: %v", err)
+		}
+	}
+	return nil
+}
+
+// stage writes current buffer to the stager as the next file of this run
+func (s *loadSink) stage(ctx context.Context) error {
+	if s.rows == 0 {
+		return nil
+	}
+	name := fmt.Sprintf("%s-%05d.json", s.run, len(s.staged))
+	uri, err := s.stager.Stage(ctx, name, s.buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("stage[%s]: %v", name, err)
+	}
+	logger.Printf("staged %d records in %s", s.rows, uri)
+	s.staged = append(s.staged, uri)
+	s.sizes = append(s.sizes, int64(s.buf.Len()))
+	s.buf.Reset()
+	s.rows = 0
+	return nil
+}
+
+// Flush stages leftovers and runs single load job for all staged files. Load job is
+// all-or-nothing, when it fails on specific rows they are rejected and the others retried
+// so the next drain loads them without the bad ones, any other error fails the whole flush
+func (s *loadSink) Flush(ctx context.Context) ([]*RecordResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() {
+		if err := s.stager.Cleanup(ctx, s.staged); err != nil {
+			logger.Printf("error cleaning up staged files: %v", err)
+		}
+		s.buf.Reset()
+		s.rows = 0
+		s.staged = make([]string, 0)
+		s.sizes = make([]int64, 0)
+		s.pending = make([]*Record, 0)
+		s.positions = nil
+	}()
+
+	if err := s.stage(ctx); err != nil {
+		return nil, err
+	}
+	if len(s.staged) == 0 {
+		return []*RecordResult{}, nil
+	}
+
+	src, err := s.stager.Source(ctx, s.staged)
+	if err != nil {
+		return nil, fmt.Errorf("load source: %v", err)
+	}
+
+	loader := s.table.LoaderFrom(src)
+	loader.WriteDisposition = bigquery.WriteAppend
+	loader.CreateDisposition = bigquery.CreateNever
+
+	logger.Printf("loading %d records from %d files...", len(s.pending), len(s.staged))
+	job, err := loader.Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load job: %v", err)
+	}
+	st, err := job.Wait(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load job[%s] wait: %v", job.ID(), err)
+	}
+	if err := st.Err(); err != nil {
+		bad := s.badRows(st.Errors)
+		if len(bad) == 0 {
+			return nil, fmt.Errorf("load job[%s]: %v", job.ID(), err)
+		}
+		logger.Printf("load job[%s] failed on %d of %d records: %v", job.ID(), len(bad), len(s.pending), err)
+		results := make([]*RecordResult, 0, len(s.pending))
+		for i, rec := range s.pending {
+			if rowErr, ok := bad[i]; ok {
+				// columns of new fields may be added by then
+				retry := cfg.Schema.Evolve == evolveModeOn && strings.Contains(strings.ToLower(rowErr.Error()), "no such field")
+				results = append(results, &RecordResult{Record: rec, Err: rowErr, Retry: retry})
+				continue
+			}
+			results = append(results, &RecordResult{
+				Record: rec,
+				Err:    fmt.Errorf("load job[%s] failed on other records", job.ID()),
+				Retry:  true,
+			})
+		}
+		return results, nil
+	}
+
+	results := make([]*RecordResult, 0, len(s.pending))
+	for _, rec := range s.pending {
+		results = append(results, &RecordResult{Record: rec})
+	}
+	return results, nil
+}
+
+// badRows returns errors of the pending records the load job failed on by their index.
+// Errors of rows in staged file carry its URI, uploaded files are read as one stream
+// so their errors carry position in all of them
+func (s *loadSink) badRows(errs []*bigquery.Error) map[int]error {
+	index := make(map[rowPosition]int, len(s.positions))
+	for i, pos := range s.positions {
+		index[pos] = i
+	}
+	bad := make(map[int]error)
+	for _, e := range errs {
+		if e == nil {
+			continue
+		}
+		m := rowErrorPosition.FindStringSubmatch(e.Message)
+		if m == nil {
+			continue
+		}
+		offset, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		file := s.fileIndex(e.Location)
+		if file < 0 {
+			if f := rowErrorFile.FindStringSubmatch(e.Message); f != nil {
+				file = s.fileIndex(strings.TrimSuffix(f[1], "."))
+			}
+		}
+		if file < 0 {
+			file, offset = s.filePosition(offset)
+		}
+		if i, ok := index[rowPosition{file: file, offset: offset}]; ok {
+			bad[i] = fmt.Errorf("load: %s", e.Message)
+		}
+	}
+	return bad
+}
+
+// fileIndex returns index of the staged file, -1 when uri isn't one
+func (s *loadSink) fileIndex(uri string) int {
+	for i, staged := range s.staged {
+		if uri != "" && uri == staged {
+			return i
+		}
+	}
+	return -1
+}
+
+// filePosition converts offset in all staged files into file index and offset in it
+func (s *loadSink) filePosition(offset int64) (int, int64) {
+	for i, size := range s.sizes {
+		if offset < size {
+			return i, offset
+		}
+		offset -= size
+	}
+	return -1, offset
+}
+
+func (s *loadSink) Close() error {
+	s.stager.Close()
+	return s.client.Close()
+}
+
+// gcsStager stores staged files in GCS bucket under optional prefix
+type gcsStager struct {
+	client *storage.Client
+	bucket string
+	prefix string
+}
+
+func newGCSStager(ctx context.Context, location string) (*gcsStager, error) {
+	path := strings.TrimPrefix(location, gcsScheme)
+	parts := strings.SplitN(path, "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("invalid staging location: %s", location)
+	}
+	prefix := ""
+	if len(parts) == 2 {
+		prefix = strings.Trim(parts[1], "/")
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage client: %v", err)
+	}
+	return &gcsStager{
+		client: client,
+		bucket: parts[0],
+		prefix: prefix,
+	}, nil
+}
+
+func (s *gcsStager) object(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+func (s *gcsStager) Stage(ctx context.Context, name string, data []byte) (uri string, err error) {
+	obj := s.object(name)
+	w := s.client.Bucket(s.bucket).Object(obj).NewWriter(ctx)
+	w.ContentType = "application/x-ndjson"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s/%s", gcsScheme, s.bucket, obj), nil
+}
+
+func (s *gcsStager) Source(ctx context.Context, uris []string) (bigquery.LoadSource, error) {
+	ref := bigquery.NewGCSReference(uris...)
+	ref.SourceFormat = bigquery.JSON
+	return ref, nil
+}
+
+func (s *gcsStager) Cleanup(ctx context.Context, uris []string) error {
+	for _, uri := range uris {
+		obj := strings.TrimPrefix(uri, fmt.Sprintf("%s%s/", gcsScheme, s.bucket))
+		if err := s.client.Bucket(s.bucket).Object(obj).Delete(ctx); err != nil {
+			return fmt.Errorf("delete[%s]: %v", uri, err)
+		}
+	}
+	return nil
+}
+
+func (s *gcsStager) Close() error {
+	return s.client.Close()
+}
+
+// localStager stores staged files in local directory, used in local runs and tests.
+// Files are uploaded with the load job as they are not reachable by BigQuery
+type localStager struct {
+	dir   string
+	files []*os.File
+}
+
+func newLocalStager(dir string) (*localStager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("staging dir[%s]: %v", dir, err)
+	}
+	return &localStager{dir: dir}, nil
+}
+
+func (s *localStager) Stage(ctx context.Context, name string, data []byte) (uri string, err error) {
+	path := filepath.Join(s.dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (s *localStager) Source(ctx context.Context, uris []string) (bigquery.LoadSource, error) {
+	s.closeFiles()
+	readers := make([]io.Reader, 0, len(uris))
+	for _, uri := range uris {
+		f, err := os.Open(uri)
+		if err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+		readers = append(readers, f)
+	}
+	src := bigquery.NewReaderSource(io.MultiReader(readers...))
+	src.SourceFormat = bigquery.JSON
+	return src, nil
+}
+
+func (s *localStager) closeFiles() {
+	for _, f := range s.files {
+		f.Close()
+	}
+	s.files = nil
+}
+
+func (s *localStager) Cleanup(ctx context.Context, uris []string) error {
+	s.closeFiles()
+	for _, uri := range uris {
+		if err := os.Remove(uri); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("delete[%s]: %v", uri, err)
+		}
+	}
+	return nil
+}
+
+func (s *localStager) Close() error {
+	s.closeFiles()
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestLoadSinkBadRows(t *testing.T) {
+	ctx := context.Background()
+	stager, err := newLocalStager(t.TempDir())
+	if err != nil {
+		t.Fatalf("error creating stager: %v", err)
+	}
+	s := &loadSink{stager: stager, chunk: 2, run: "test", staged: []string{}, sizes: []int64{}}
+
+	for i := 0; i < 5; i++ {
+		rec := &Record{ID: fmt.Sprint(i), Values: simpleRecord{"n": i}}
+		if err := s.Append(ctx, rec); err != nil {
+			t.Fatalf("error appending record: %v", err)
+		}
+	}
+	if err := s.stage(ctx); err != nil {
+		t.Fatalf("error staging: %v", err)
+	}
+	if len(s.staged) != 3 {
+		t.Fatalf("got %d staged files, want 3", len(s.staged))
+	}
+	b, err := os.ReadFile(s.staged[1])
+	if err != nil {
+		t.Fatalf("error reading staged file: %v", err)
+	}
+	if string(b) != "{\"n\":2}\n{\"n\":3}\n" {
+		t.Fatalf("got staged file %q", b)
+	}
+
+	second := len("{\"n\":2}\n")
+	bad := s.badRows([]*bigquery.Error{
+		// row of staged file
+		{Location: s.staged[1], Message: fmt.Sprintf(
+			"Error while reading data, error message: JSON parsing error in row starting at position %d: No such field: x.", second)},
+		// row of uploaded files is at position in all of them
+		{Message: fmt.Sprintf(
+			"Error while reading data, error message: JSON parsing error in row starting at position %d: No such field: y.", s.sizes[0]+s.sizes[1])},
+		// job level errors don't point at any row
+		{Message: "Error while reading data, error message: JSON table encountered too many errors, giving up. Rows: 2; errors: 2."},
+	})
+	rows := make([]string, 0)
+	for i, err := range bad {
+		rows = append(rows, fmt.Sprintf("%d:%v", i, err))
+	}
+	sort.Strings(rows)
+	if len(rows) != 2 || !strings.HasPrefix(rows[0], "3:") || !strings.HasPrefix(rows[1], "4:") {
+		t.Errorf("got bad rows %v, want 3 and 4", rows)
+	}
+
+	if err := stager.Cleanup(ctx, s.staged); err != nil {
+		t.Fatalf("error cleaning up: %v", err)
+	}
+	if _, err := os.Stat(s.staged[0]); !os.IsNotExist(err) {
+		t.Errorf("staged file not deleted: %v", err)
+	}
+}
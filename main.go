@@ -1,35 +1,83 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net"
 	"os"
-	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/mchmarny/gcputil/env"
 	"github.com/mchmarny/gcputil/project"
 )
 
 var (
 	//service
-	logger    = log.New(os.Stdout, "[PUMP] ", 0)
-	port      = env.MustGetEnvVar("PORT", "8080")
-	release   = env.MustGetEnvVar("RELEASE", "v0.0.1-default")
-	debug     = env.MustGetIntEnvVar("DEBUG", 0)
-	projectID = project.GetIDOrFail()
+	logger = log.New(os.Stdout, "[PUMP] ", 0)
 
-	accessToken = strings.TrimSpace(env.MustGetEnvVar("TOKEN", ""))
-	maxStall    = env.MustGetIntEnvVar("MAX_STALL", 30)
-	maxDuration = env.MustGetIntEnvVar("MAX_DURATION", 900)
-	batchSize   = env.MustGetIntEnvVar("BATCH_SIZE", 100)
-	subName     = strings.TrimSpace(env.MustGetEnvVar("SUB", ""))
-	dsName      = strings.TrimSpace(env.MustGetEnvVar("DATSET", ""))
-	tblName     = strings.TrimSpace(env.MustGetEnvVar("TABLE", ""))
+	// resolved on start rather than on init so tests don't need the metadata server
+	projectID string
+)
+
+var (
+	// config loaded on start
+	cfg *Config
 )
 
 func main() {
 
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"),
+		"YAML or JSON config file (local path or gs://bucket/object)")
+	validateOnly := flag.Bool("validate-config", false,
+		"validate config, report all problems, and exit")
+	scriptSamples := flag.String("test-script", "",
+		"process each line of the samples file as message, print the records, and exit")
+	scriptPipeline := flag.String("pipeline", "",
+		"name of the pipeline processing the script samples, the first one by default")
+	flag.Parse()
+
+	c, err := LoadConfig(context.Background(), *configFile)
+	if err != nil {
+		logger.Fatalf("error loading config: %v", err)
+	}
+	cfg = c
+
+	// script test only needs the message processing settings
+	if *scriptSamples != "" {
+		failed, err := testScript(context.Background(), *scriptSamples, *scriptPipeline, os.Stdout)
+		if err != nil {
+			logger.Fatalf("error testing script: %v", err)
+		}
+		if failed > 0 {
+			logger.Printf("processing failed on %d sample(s)", failed)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	problems := c.Validate()
+	for _, p := range problems {
+		logger.Printf("config: %v", p)
+	}
+	if *validateOnly {
+		if len(problems) > 0 {
+			logger.Printf("config invalid: %d problem(s)", len(problems))
+			os.Exit(1)
+		}
+		logger.Printf("config valid")
+		os.Exit(0)
+	}
+	if len(problems) > 0 {
+		logger.Fatalf("invalid config: %d problem(s)", len(problems))
+	}
+
+	// script test and config validation run locally without the project
+	projectID = project.GetIDOrFail()
+
+	for _, p := range c.Pipelines {
+		logger.Printf("pipeline %s: %s -> %s.%s", p.Name, p.Subscription, p.Dataset, p.Table)
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 
 	// router
@@ -45,10 +93,11 @@ func main() {
 	v1 := r.Group("/v1")
 	{
 		v1.POST("/notif", notifHandler)
+		v1.POST("/push", pushHandler)
 	}
 
 	// server
-	hostPort := net.JoinHostPort("0.0.0.0", port)
+	hostPort := net.JoinHostPort("0.0.0.0", cfg.Port)
 	logger.Printf("Server starting: %s \n", hostPort)
 	if err := r.Run(hostPort); err != nil {
 		logger.Fatal(err)
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	// metadata columns
+	metaMessageID       = "message_id"
+	metaPublishTime     = "publish_time"
+	metaAttributes      = "attributes"
+	metaOrderingKey     = "ordering_key"
+	metaDeliveryAttempt = "delivery_attempt"
+	metaIngestedAt      = "ingested_at"
+	metaSubscription    = "subscription"
+
+	// attributes column formats
+	attributesFormatJSON     = "json"
+	attributesFormatRepeated = "repeated"
+)
+
+var (
+	// metadata column types, attributes type depends on the format
+	metadataTypes = map[string]bigquery.FieldType{
+		metaMessageID:       bigquery.StringFieldType,
+		metaPublishTime:     bigquery.TimestampFieldType,
+		metaAttributes:      bigquery.StringFieldType,
+		metaOrderingKey:     bigquery.StringFieldType,
+		metaDeliveryAttempt: bigquery.IntegerFieldType,
+		metaIngestedAt:      bigquery.TimestampFieldType,
+		metaSubscription:    bigquery.StringFieldType,
+	}
+)
+
+// Metadata adds message metadata columns to each record, named by the metadata key with prefix
+type Metadata struct {
+	columns      []string
+	prefix       string
+	attributes   string
+	subscription string
+}
+
+// NewMetadata creates metadata for records of the subscription, nil when no columns are configured
+func NewMetadata(cfg MetadataConfig, subscription string) (*Metadata, error) {
+	if len(cfg.Columns) == 0 {
+		return nil, nil
+	}
+	for _, col := range cfg.Columns {
+		if _, ok := metadataTypes[col]; !ok {
+			return nil, fmt.Errorf("invalid metadata column: %s", col)
+		}
+	}
+	switch cfg.Attributes {
+	case attributesFormatJSON, attributesFormatRepeated:
+	default:
+		return nil, fmt.Errorf("invalid attributes format: %s", cfg.Attributes)
+	}
+	return &Metadata{
+		columns:      cfg.Columns,
+		prefix:       cfg.Prefix,
+		attributes:   cfg.Attributes,
+		subscription: subscription,
+	}, nil
+}
+
+// Add sets the metadata columns of record overwriting fields of the same name. Values are
+// in decoded JSON form so they are coerced into the table schema like the message fields
+func (m *Metadata) Add(msg *Message, rec simpleRecord, now time.Time) {
+	for _, col := range m.columns {
+		var v interface{}
+		switch col {
+		case metaMessageID:
+			v = msg.ID
+		case metaPublishTime:
+			v = msg.PublishTime.UTC().Format(time.RFC3339Nano)
+		case metaAttributes:
+			v = m.attributeValue(msg.Attributes)
+		case metaOrderingKey:
+			v = msg.OrderingKey
+		case metaDeliveryAttempt:
+			if msg.DeliveryAttempt != nil {
+				v = json.Number(strconv.Itoa(*msg.DeliveryAttempt))
+			}
+		case metaIngestedAt:
+			v = now.UTC().Format(time.RFC3339Nano)
+		case metaSubscription:
+			v = m.subscription
+		}
+		rec[m.prefix+col] = v
+	}
+}
+
+// attributeValue returns attributes as JSON object string or list of key/value records sorted by key
+func (m *Metadata) attributeValue(attrs map[string]string) interface{} {
+	if m.attributes == attributesFormatJSON {
+		// string map always encodes
+		b, _ := json.Marshal(attrs)
+		return string(b)
+	}
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]interface{}, 0, len(attrs))
+	for _, k := range keys {
+		list = append(list, map[string]interface{}{"key": k, "value": attrs[k]})
+	}
+	return list
+}
+
+// Schema returns the metadata columns
+func (m *Metadata) Schema() bigquery.Schema {
+	schema := make(bigquery.Schema, 0, len(m.columns))
+	for _, col := range m.columns {
+		f := &bigquery.FieldSchema{Name: m.prefix + col, Type: metadataTypes[col]}
+		if col == metaAttributes && m.attributes == attributesFormatRepeated {
+			f.Type = bigquery.RecordFieldType
+			f.Repeated = true
+			f.Schema = bigquery.Schema{
+				{Name: "key", Type: bigquery.StringFieldType},
+				{Name: "value", Type: bigquery.StringFieldType},
+			}
+		}
+		schema = append(schema, f)
+	}
+	return schema
+}
+
+// WithSchema returns copy of schema with the metadata columns replacing the inferred ones
+func (m *Metadata) WithSchema(schema bigquery.Schema) bigquery.Schema {
+	out := make(bigquery.Schema, 0, len(schema)+len(m.columns))
+	index := make(map[string]int, len(schema))
+	for i, f := range schema {
+		out = append(out, f)
+		index[strings.ToLower(f.Name)] = i
+	}
+	for _, f := range m.Schema() {
+		if i, ok := index[strings.ToLower(f.Name)]; ok {
+			out[i] = f
+			continue
+		}
+		out = append(out, f)
+	}
+	return out
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestMetadataAdd(t *testing.T) {
+	attempt := 3
+	msg := &Message{
+		ID:              "m1",
+		PublishTime:     time.Date(2022, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600)),
+		Attributes:      map[string]string{"b": "2", "a": "1"},
+		OrderingKey:     "k",
+		DeliveryAttempt: &attempt,
+	}
+	now := time.Date(2022, 1, 2, 3, 5, 0, 0, time.UTC)
+	all := []string{metaMessageID, metaPublishTime, metaAttributes, metaOrderingKey,
+		metaDeliveryAttempt, metaIngestedAt, metaSubscription}
+
+	tests := []struct {
+		name string
+		cfg  MetadataConfig
+		want simpleRecord
+	}{
+		{
+			name: "json attributes",
+			cfg:  MetadataConfig{Columns: all, Prefix: "_", Attributes: attributesFormatJSON},
+			want: simpleRecord{
+				"n":                 "v",
+				"_message_id":       "m1",
+				"_publish_time":     "2022-01-02T02:04:05Z",
+				"_attributes":       `{"a":"1","b":"2"}`,
+				"_ordering_key":     "k",
+				"_delivery_attempt": json.Number("3"),
+				"_ingested_at":      "2022-01-02T03:05:00Z",
+				"_subscription":     "sub",
+			},
+		},
+		{
+			name: "repeated attributes without prefix",
+			cfg:  MetadataConfig{Columns: []string{metaAttributes, metaMessageID}, Attributes: attributesFormatRepeated},
+			want: simpleRecord{
+				"n": "v",
+				"attributes": []interface{}{
+					map[string]interface{}{"key": "a", "value": "1"},
+					map[string]interface{}{"key": "b", "value": "2"},
+				},
+				"message_id": "m1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMetadata(tt.cfg, "sub")
+			if err != nil {
+				t.Fatalf("error creating metadata: %v", err)
+			}
+			rec := simpleRecord{"n": "v"}
+			m.Add(msg, rec, now)
+			if !reflect.DeepEqual(rec, tt.want) {
+				t.Errorf("got %v, want %v", rec, tt.want)
+			}
+		})
+	}
+
+	// delivery attempt is only known with dead-letter policy
+	m, _ := NewMetadata(MetadataConfig{Columns: []string{metaDeliveryAttempt}, Attributes: attributesFormatJSON}, "sub")
+	rec := simpleRecord{}
+	m.Add(&Message{}, rec, now)
+	if v, ok := rec[metaDeliveryAttempt]; !ok || v != nil {
+		t.Errorf("got delivery attempt %v, want null", v)
+	}
+}
+
+func TestMetadataWithSchema(t *testing.T) {
+	m, err := NewMetadata(MetadataConfig{
+		Columns:    []string{metaMessageID, metaAttributes},
+		Prefix:     "_",
+		Attributes: attributesFormatRepeated,
+	}, "sub")
+	if err != nil {
+		t.Fatalf("error creating metadata: %v", err)
+	}
+	// inferred columns of the same name are replaced keeping their position
+	schema := bigquery.Schema{
+		{Name: "_Attributes", Type: bigquery.StringFieldType},
+		{Name: "n", Type: bigquery.StringFieldType},
+	}
+	want := bigquery.Schema{
+		{Name: "_attributes", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+			{Name: "key", Type: bigquery.StringFieldType},
+			{Name: "value", Type: bigquery.StringFieldType},
+		}},
+		{Name: "n", Type: bigquery.StringFieldType},
+		{Name: "_message_id", Type: bigquery.StringFieldType},
+	}
+	if got := m.WithSchema(schema); !reflect.DeepEqual(got, want) {
+		t.Errorf("got schema %v, want %v", got, want)
+	}
+	if schema[0].Type != bigquery.StringFieldType {
+		t.Errorf("source schema modified")
+	}
+}
+
+func TestNewMetadataInvalid(t *testing.T) {
+	if _, err := NewMetadata(MetadataConfig{Columns: []string{"size"}, Attributes: attributesFormatJSON}, ""); err == nil {
+		t.Errorf("expected error for unknown column")
+	}
+	if _, err := NewMetadata(MetadataConfig{Columns: []string{metaAttributes}, Attributes: "csv"}, ""); err == nil {
+		t.Errorf("expected error for unknown attributes format")
+	}
+	if m, err := NewMetadata(MetadataConfig{}, ""); m != nil || err != nil {
+		t.Errorf("got metadata %v, error %v, want none without columns", m, err)
+	}
+}
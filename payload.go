@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	// payload formats
+	payloadFormatJSON     = "json"
+	payloadFormatRaw      = "raw"
+	payloadFormatAvro     = "avro"
+	payloadFormatProtobuf = "protobuf"
+
+	// schema encodings of avro and protobuf payloads
+	encodingBinary = "binary"
+	encodingJSON   = "json"
+
+	// attribute Pub/Sub sets to the encoding of messages published to topics with schema
+	schemaEncodingAttribute = "googclient_schemaencoding"
+
+	// batched envelope formats, auto is array when data starts with [ and ndjson otherwise
+	batchArray  = "array"
+	batchNDJSON = "ndjson"
+	batchAuto   = "auto"
+
+	// raw payload column types
+	rawTypeString = "string"
+	rawTypeBytes  = "bytes"
+	rawTypeJSON   = "json"
+)
+
+// PayloadDecoder decodes message data into record
+type PayloadDecoder interface {
+	Decode(data []byte, attrs map[string]string) (simpleRecord, error)
+	// Schema returns the table schema of decoded records, nil when it has to be inferred
+	Schema() bigquery.Schema
+}
+
+// NewPayloadDecoder creates decoder of the configured payload format,
+// avro and protobuf schema is read from the schema file unless it's set inline
+func NewPayloadDecoder(ctx context.Context, cfg PayloadConfig) (PayloadDecoder, error) {
+	if err := checkBatch(cfg); err != nil {
+		return nil, err
+	}
+	switch cfg.Format {
+	case payloadFormatJSON:
+		return &jsonDecoder{}, nil
+	case payloadFormatRaw:
+		if cfg.Column == "" {
+			return nil, fmt.Errorf("payload column required for %s format", cfg.Format)
+		}
+		switch cfg.Type {
+		case rawTypeString, rawTypeBytes, rawTypeJSON:
+		default:
+			return nil, fmt.Errorf("invalid raw payload type: %s", cfg.Type)
+		}
+		return &rawDecoder{column: cfg.Column, valueType: cfg.Type}, nil
+	case payloadFormatAvro, payloadFormatProtobuf:
+		if err := checkEncoding(cfg.Encoding); err != nil {
+			return nil, err
+		}
+		schema, err := payloadSchema(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Format == payloadFormatAvro {
+			return newAvroDecoder(schema, cfg.Encoding)
+		}
+		return newProtoDecoder(schema, cfg.Message, cfg.Encoding)
+	default:
+		return nil, fmt.Errorf("invalid payload format: %s", cfg.Format)
+	}
+}
+
+// jsonDecoder decodes JSON object keeping numbers as json.Number,
+// any other value including null fails
+type jsonDecoder struct{}
+
+func (d *jsonDecoder) Decode(data []byte, _ map[string]string) (simpleRecord, error) {
+	var rec simpleRecord
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&rec); err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return nil, fmt.Errorf("payload is not JSON object")
+	}
+	return rec, nil
+}
+
+func (d *jsonDecoder) Schema() bigquery.Schema {
+	return nil
+}
+
+// rawDecoder wraps the whole message data into single column so that
+// any payload (CSV lines, plain text, JSON arrays, binary data) can be archived
+type rawDecoder struct {
+	column    string
+	valueType string
+}
+
+func (d *rawDecoder) Decode(data []byte, _ map[string]string) (simpleRecord, error) {
+	var v interface{}
+	switch d.valueType {
+	case rawTypeBytes:
+		// base64 is what both the converter and the JSON based sinks expect for bytes
+		v = base64.StdEncoding.EncodeToString(data)
+	case rawTypeJSON:
+		if !json.Valid(data) {
+			return nil, fmt.Errorf("invalid JSON payload")
+		}
+		v = string(data)
+	default:
+		v = strings.ToValidUTF8(string(data), "�")
+	}
+	return simpleRecord{d.column: v}, nil
+}
+
+func (d *rawDecoder) Schema() bigquery.Schema {
+	t := bigquery.StringFieldType
+	switch d.valueType {
+	case rawTypeBytes:
+		t = bigquery.BytesFieldType
+	case rawTypeJSON:
+		t = jsonFieldType
+	}
+	return bigquery.Schema{{Name: d.column, Type: t}}
+}
+
+// payloadSchema returns the inline schema or reads it from the schema file
+func payloadSchema(ctx context.Context, cfg PayloadConfig) ([]byte, error) {
+	if cfg.Schema != "" {
+		return []byte(cfg.Schema), nil
+	}
+	if cfg.SchemaFile == "" {
+		return nil, fmt.Errorf("payload schema or schema file required for %s format", cfg.Format)
+	}
+	b, err := readFile(ctx, cfg.SchemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("schema file[%s]: %v", cfg.SchemaFile, err)
+	}
+	return b, nil
+}
+
+func checkEncoding(encoding string) error {
+	switch encoding {
+	case encodingBinary, encodingJSON:
+		return nil
+	default:
+		return fmt.Errorf("invalid payload encoding: %q", encoding)
+	}
+}
+
+// messageEncoding returns the encoding Pub/Sub set in message attributes, the configured one when there is none
+func messageEncoding(attrs map[string]string, encoding string) string {
+	if v := attrs[schemaEncodingAttribute]; v != "" {
+		return strings.ToLower(v)
+	}
+	return encoding
+}
+
+// floatValue returns float in decoded JSON form, JSON has no NaN or infinity so those are strings
+func floatValue(f float64, bitSize int) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, bitSize))
+}
+
+func checkBatch(cfg PayloadConfig) error {
+	switch cfg.Batch {
+	case "":
+		return nil
+	case batchArray, batchNDJSON, batchAuto:
+	default:
+		return fmt.Errorf("invalid payload batch: %q", cfg.Batch)
+	}
+	if cfg.Format != payloadFormatJSON && cfg.Format != payloadFormatRaw {
+		return fmt.Errorf("payload batch requires %s or %s format", payloadFormatJSON, payloadFormatRaw)
+	}
+	if cfg.IndexColumn == "" {
+		return fmt.Errorf("payload index column required for batch")
+	}
+	return nil
+}
+
+// splitBatch returns items of batched envelope, JSON array elements or non-empty NDJSON lines.
+// Data is single item when there is no batch
+func splitBatch(data []byte, batch string) ([][]byte, error) {
+	if batch == "" {
+		return [][]byte{data}, nil
+	}
+	data = bytes.TrimSpace(data)
+	if batch == batchAuto {
+		batch = batchNDJSON
+		if bytes.HasPrefix(data, []byte("[")) {
+			batch = batchArray
+		}
+	}
+	if batch == batchArray {
+		var list []json.RawMessage
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("invalid batch array: %v", err)
+		}
+		if list == nil {
+			return nil, fmt.Errorf("invalid batch array: %s", data)
+		}
+		items := make([][]byte, 0, len(list))
+		for _, item := range list {
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	items := make([][]byte, 0)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			items = append(items, line)
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestJSONDecoderRejectsNonObjects(t *testing.T) {
+	d := &jsonDecoder{}
+	for _, data := range []string{`null`, `[1]`, `"text"`, `1`, ``} {
+		if rec, err := d.Decode([]byte(data), nil); err == nil {
+			t.Errorf("decoded %q to %v, want error", data, rec)
+		}
+	}
+	rec, err := d.Decode([]byte(`{"n":1}`), nil)
+	if err != nil || rec["n"] == nil {
+		t.Errorf("got %v (%v) for object", rec, err)
+	}
+}
+
+func TestPumpDeadLettersNullPayloads(t *testing.T) {
+	p := testPipeline(t)
+	p.Payload.Batch = batchArray
+
+	src := newMemorySource([]*Message{
+		testMessage("null", `null`),
+		testMessage("null-item", `[{"n":1},null]`),
+		testMessage("ok", `[{"n":1},{"n":2}]`),
+	})
+	r, err := pump(p, src)
+	if err != nil {
+		t.Fatalf("error on pump: %v", err)
+	}
+	if r.Filtered != 0 || r.Accepted != 2 || r.Rejected != 2 {
+		t.Errorf("got %d filtered, %d accepted, %d rejected, want 0, 2, 2",
+			r.Filtered, r.Accepted, r.Rejected)
+	}
+	dl := deadLettered(t)
+	if _, ok := dl["null"]; !ok {
+		t.Errorf("null payload not dead-lettered: %v", dl)
+	}
+	if _, ok := dl["null-item"]; !ok {
+		t.Errorf("batch with null item not dead-lettered: %v", dl)
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		batch string
+		data  string
+		want  []string
+	}{
+		{"no batch", "", `[{"n":1}]`, []string{`[{"n":1}]`}},
+		{"array", batchArray, ` [{"n":1}, {"n":2}] `, []string{`{"n":1}`, `{"n":2}`}},
+		{"empty array", batchArray, `[]`, []string{}},
+		{"ndjson", batchNDJSON, "{\"n\":1}\n\n {\"n\":2} \r\n", []string{`{"n":1}`, `{"n":2}`}},
+		{"auto array", batchAuto, ` [{"n":1}]`, []string{`{"n":1}`}},
+		{"auto ndjson", batchAuto, "{\"n\":1}\n{\"n\":2}", []string{`{"n":1}`, `{"n":2}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := splitBatch([]byte(tt.data), tt.batch)
+			if err != nil {
+				t.Fatalf("error splitting: %v", err)
+			}
+			got := make([]string, 0, len(items))
+			for _, item := range items {
+				got = append(got, string(item))
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := splitBatch([]byte(`{"n":1}`), batchArray); err == nil {
+		t.Errorf("expected error for object as batch array")
+	}
+}
+
+func TestProcessBatchRows(t *testing.T) {
+	p := testPipeline(t)
+	p.Payload.Batch = batchNDJSON
+	proc, err := NewProcessor(context.Background(), p)
+	if err != nil {
+		t.Fatalf("error creating processor: %v", err)
+	}
+	records, _, _, err := proc.Process(testMessage("m1", "{\"n\":1}\n{\"n\":2}\n"))
+	if err != nil {
+		t.Fatalf("error processing: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	// rows keep their position in the envelope
+	for i, rec := range records {
+		if rec[p.Payload.IndexColumn] != json.Number(strconv.Itoa(i)) {
+			t.Errorf("row %d: got index %v", i, rec[p.Payload.IndexColumn])
+		}
+	}
+
+	// message fails as a whole when any of its rows can't be decoded
+	if _, _, _, err := proc.Process(testMessage("m2", "{\"n\":1}\nnot json\n")); err == nil ||
+		!strings.Contains(err.Error(), "row 1") {
+		t.Errorf("got %v, want error of row 1", err)
+	}
+}
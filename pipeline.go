@@ -0,0 +1,32 @@
+package main
+
+// Pipeline drains single subscription into single table. Unset batch size, limits,
+// and payload default to the top level config ones
+type Pipeline struct {
+	Name         string         `yaml:"name"`
+	Subscription string         `yaml:"subscription"`
+	Dataset      string         `yaml:"dataset"`
+	Table        string         `yaml:"table"`
+	BatchSize    int            `yaml:"batch_size"`
+	MaxStall     int            `yaml:"max_stall"`
+	MaxDuration  int            `yaml:"max_duration"`
+	Payload      *PayloadConfig `yaml:"payload"`
+}
+
+// findPipeline returns pipeline draining the subscription, nil when there is none
+func findPipeline(list []*Pipeline, sub string) *Pipeline {
+	for _, p := range list {
+		if p.Subscription == sub {
+			return p
+		}
+	}
+	return nil
+}
+
+// sourceTarget returns subscription name or file path depending on source type
+func (p *Pipeline) sourceTarget() string {
+	if cfg.Source.Type == sourceTypeFile {
+		return cfg.Source.File
+	}
+	return p.Subscription
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Processor turns message into records: decompresses its payload, unwraps CloudEvents, decodes
+// the payload into rows, applies the filter, runs each row through the transform and script
+// steps, and adds the metadata columns. All but the decoder are optional
+type Processor struct {
+	decompressor *Decompressor
+	events       *CloudEvents
+	decoder      PayloadDecoder
+	batch        string
+	indexColumn  string
+	filter       *Filter
+	transformer  *Transformer
+	script       *Script
+	metadata     *Metadata
+}
+
+// NewProcessor creates processor of the configured steps for messages of the pipeline
+func NewProcessor(ctx context.Context, p *Pipeline) (*Processor, error) {
+	decompressor, err := NewDecompressor(cfg.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("compression: %v", err)
+	}
+	events, err := NewCloudEvents(cfg.CloudEvents)
+	if err != nil {
+		return nil, fmt.Errorf("cloudevents: %v", err)
+	}
+	decoder, err := NewPayloadDecoder(ctx, *p.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("payload: %v", err)
+	}
+	filter, err := NewFilter(cfg.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("filter: %v", err)
+	}
+	transformer, err := NewTransformer(cfg.Transform)
+	if err != nil {
+		return nil, fmt.Errorf("transformer: %v", err)
+	}
+	script, err := NewScript(ctx, cfg.Script)
+	if err != nil {
+		return nil, err
+	}
+	// raw payload is archived along with the metadata identifying its message
+	metaCfg := cfg.Metadata
+	if p.Payload.Format == payloadFormatRaw && len(metaCfg.Columns) == 0 {
+		metaCfg.Columns = []string{metaMessageID, metaPublishTime, metaAttributes}
+	}
+	metadata, err := NewMetadata(metaCfg, p.Subscription)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %v", err)
+	}
+	return &Processor{
+		decompressor: decompressor,
+		events:       events,
+		decoder:      decoder,
+		batch:        p.Payload.Batch,
+		indexColumn:  p.Payload.IndexColumn,
+		filter:       filter,
+		transformer:  transformer,
+		script:       script,
+		metadata:     metadata,
+	}, nil
+}
+
+// Process returns records of the message, or no records along with the filter action other
+// than insert and its rule. Script may return no records to skip the message too
+func (p *Processor) Process(msg *Message) (records []simpleRecord, action, rule string, err error) {
+	rows, decodeErr := p.decode(msg)
+	if p.filter != nil {
+		if decodeErr != nil {
+			if action, rule = p.filter.Apply(msg, nil); action != filterActionInsert {
+				return nil, action, rule, nil
+			}
+		}
+		kept := 0
+		for i, rec := range rows {
+			switch a, r := p.filter.Apply(msg, rec); a {
+			case filterActionInsert:
+				kept++
+			case filterActionDeadLetter:
+				return nil, a, r, nil
+			default:
+				rows[i] = nil
+				action, rule = a, r
+			}
+		}
+		if len(rows) > 0 && kept == 0 {
+			return nil, action, rule, nil
+		}
+		action, rule = filterActionInsert, ""
+	}
+	if decodeErr != nil {
+		logger.Printf("error decoding %q\n", msg.Data)
+		return nil, action, rule, decodeErr
+	}
+
+	now := time.Now()
+	for i, rec := range rows {
+		if rec == nil {
+			continue
+		}
+		out, err := p.processRow(msg, rec)
+		if err != nil {
+			if p.batch != "" {
+				return nil, action, rule, fmt.Errorf("row %d: %v", i, err)
+			}
+			return nil, action, rule, err
+		}
+		for _, r := range out {
+			if p.batch != "" {
+				r[p.indexColumn] = json.Number(strconv.Itoa(i))
+			}
+			if p.metadata != nil {
+				p.metadata.Add(msg, r, now)
+			}
+			records = append(records, r)
+		}
+	}
+	return records, action, rule, nil
+}
+
+// decode decompresses the message data, unwraps the event data, and decodes each of its rows,
+// data is single row unless it's batched envelope. Event without data is single row of its columns
+func (p *Processor) decode(msg *Message) ([]simpleRecord, error) {
+	data := msg.Data
+	var err error
+	if p.decompressor != nil {
+		if data, err = p.decompressor.Decompress(msg); err != nil {
+			return nil, err
+		}
+	}
+	var event map[string]string
+	if p.events != nil {
+		if event, data, err = p.events.Unwrap(msg, data); err != nil {
+			return nil, err
+		}
+		if data == nil {
+			rec := make(simpleRecord)
+			p.events.Add(rec, event)
+			return []simpleRecord{rec}, nil
+		}
+	}
+	items, err := splitBatch(data, p.batch)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]simpleRecord, 0, len(items))
+	for i, item := range items {
+		rec, err := p.decoder.Decode(item, msg.Attributes)
+		if err == nil && rec == nil {
+			err = fmt.Errorf("payload decoded to no record")
+		}
+		if err != nil {
+			if p.batch != "" {
+				return nil, fmt.Errorf("row %d: %v", i, err)
+			}
+			return nil, err
+		}
+		if p.events != nil {
+			p.events.Add(rec, event)
+		}
+		rows = append(rows, rec)
+	}
+	return rows, nil
+}
+
+// processRow runs the row through the transform and script steps
+func (p *Processor) processRow(msg *Message, rec simpleRecord) ([]simpleRecord, error) {
+	var err error
+	if p.transformer != nil {
+		if rec, err = p.transformer.Transform(rec); err != nil {
+			return nil, fmt.Errorf("transform: %v", err)
+		}
+	}
+	if p.script != nil {
+		return p.script.Run(msg, rec)
+	}
+	return []simpleRecord{rec}, nil
+}
+
+// Schema returns the table schema of the records when the payload format defines it,
+// nil when it has to be inferred. Transform and script may change the records so their
+// schema is only known when neither is set
+func (p *Processor) Schema() bigquery.Schema {
+	schema := p.decoder.Schema()
+	if schema == nil || p.transformer != nil || p.script != nil {
+		return nil
+	}
+	if p.events != nil {
+		schema = p.events.WithSchema(schema)
+	}
+	if p.batch != "" {
+		schema = append(schema, &bigquery.FieldSchema{Name: p.indexColumn, Type: bigquery.IntegerFieldType})
+	}
+	return p.WithMetadata(schema)
+}
+
+// WithMetadata returns copy of schema with the metadata columns
+func (p *Processor) WithMetadata(schema bigquery.Schema) bigquery.Schema {
+	if p.metadata == nil {
+		return schema
+	}
+	return p.metadata.WithSchema(schema)
+}
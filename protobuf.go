@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoDecoder decodes protobuf binary or JSON encoded messages of type from descriptor set
+type protoDecoder struct {
+	desc     protoreflect.MessageDescriptor
+	encoding string
+}
+
+// newProtoDecoder creates decoder of the message type from descriptor set (protoc --descriptor_set_out
+// with --include_imports), the set may be base64 encoded so that it can be set inline
+func newProtoDecoder(schema []byte, message, encoding string) (*protoDecoder, error) {
+	if message == "" {
+		return nil, fmt.Errorf("payload message type required for %s format", payloadFormatProtobuf)
+	}
+	if b, err := base64.StdEncoding.DecodeString(string(schema)); err == nil {
+		schema = b
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(schema, &set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %v", err)
+	}
+	files := new(protoregistry.Files)
+	for _, fdp := range set.GetFile() {
+		fd, err := protodesc.NewFile(fdp, protoResolver{files})
+		if err != nil {
+			return nil, fmt.Errorf("invalid descriptor set: %v", err)
+		}
+		if err := files.RegisterFile(fd); err != nil {
+			return nil, fmt.Errorf("invalid descriptor set: %v", err)
+		}
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, fmt.Errorf("message type %s: %v", message, err)
+	}
+	desc, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not message type", message)
+	}
+	if protoScalarType(desc) {
+		return nil, fmt.Errorf("message type %s does not decode to record", message)
+	}
+	return &protoDecoder{desc: desc, encoding: encoding}, nil
+}
+
+// protoResolver resolves descriptor set files, falling back to the well known types
+// so that sets built without their imports still work
+type protoResolver struct {
+	files *protoregistry.Files
+}
+
+func (r protoResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := r.files.FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r protoResolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if d, err := r.files.FindDescriptorByName(name); err == nil {
+		return d, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+func (d *protoDecoder) Decode(data []byte, attrs map[string]string) (simpleRecord, error) {
+	m := dynamicpb.NewMessage(d.desc)
+	var err error
+	switch enc := messageEncoding(attrs, d.encoding); enc {
+	case encodingBinary:
+		err = proto.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, m)
+	case encodingJSON:
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, m)
+	default:
+		return nil, fmt.Errorf("unsupported message encoding: %q", enc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := protoMessageValue(m).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("message type %s does not decode to record", d.desc.FullName())
+	}
+	rec := make(simpleRecord, len(fields))
+	for k, v := range fields {
+		rec[k] = v
+	}
+	return rec, nil
+}
+
+// Schema returns table schema of the message type, nil when it's recursive so it's inferred
+func (d *protoDecoder) Schema() bigquery.Schema {
+	schema, err := protoSchema(d.desc, make(map[protoreflect.FullName]bool))
+	if err != nil {
+		logger.Printf("protobuf schema not mapped onto table schema: %v", err)
+		return nil
+	}
+	return schema
+}
+
+// protoMessageValue converts message into decoded JSON form using the proto field names.
+// Unset fields without presence have their zero value, maps become key/value records
+func protoMessageValue(m protoreflect.Message) interface{} {
+	if v, ok := protoWellKnownValue(m); ok {
+		return v
+	}
+	fields := m.Descriptor().Fields()
+	rec := make(map[string]interface{}, fields.Len())
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.HasPresence() && !m.Has(fd) {
+			continue
+		}
+		rec[string(fd.Name())] = protoFieldValue(fd, m.Get(fd))
+	}
+	return rec
+}
+
+func protoFieldValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch {
+	case fd.IsList():
+		list := v.List()
+		out := make([]interface{}, 0, list.Len())
+		for i := 0; i < list.Len(); i++ {
+			out = append(out, protoScalarValue(fd, list.Get(i)))
+		}
+		return out
+	case fd.IsMap():
+		type entry struct {
+			key   string
+			value interface{}
+		}
+		entries := make([]entry, 0, v.Map().Len())
+		v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+			entries = append(entries, entry{k.String(), map[string]interface{}{
+				"key":   protoScalarValue(fd.MapKey(), k.Value()),
+				"value": protoScalarValue(fd.MapValue(), mv),
+			}})
+			return true
+		})
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+		out := make([]interface{}, 0, len(entries))
+		for _, e := range entries {
+			out = append(out, e.value)
+		}
+		return out
+	default:
+		return protoScalarValue(fd, v)
+	}
+}
+
+func protoScalarValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return v.Bool()
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return json.Number(strconv.FormatInt(int64(v.Enum()), 10))
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return json.Number(strconv.FormatInt(v.Int(), 10))
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return json.Number(strconv.FormatUint(v.Uint(), 10))
+	case protoreflect.FloatKind:
+		return floatValue(v.Float(), 32)
+	case protoreflect.DoubleKind:
+		return floatValue(v.Float(), 64)
+	case protoreflect.StringKind:
+		return v.String()
+	case protoreflect.BytesKind:
+		return base64.StdEncoding.EncodeToString(v.Bytes())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return protoMessageValue(v.Message())
+	default:
+		return nil
+	}
+}
+
+// protoWellKnownValue converts timestamp, duration, wrapper, and struct messages
+// into the values their JSON mapping defines
+func protoWellKnownValue(m protoreflect.Message) (interface{}, bool) {
+	md := m.Descriptor()
+	fields := md.Fields()
+	switch md.FullName() {
+	case "google.protobuf.Timestamp":
+		secs, nanos := m.Get(fields.ByName("seconds")).Int(), m.Get(fields.ByName("nanos")).Int()
+		return time.Unix(secs, nanos).UTC().Format(time.RFC3339Nano), true
+	case "google.protobuf.Duration":
+		secs, nanos := m.Get(fields.ByName("seconds")).Int(), m.Get(fields.ByName("nanos")).Int()
+		d := float64(secs) + float64(nanos)/float64(time.Second)
+		return strconv.FormatFloat(d, 'f', -1, 64) + "s", true
+	case "google.protobuf.DoubleValue", "google.protobuf.FloatValue",
+		"google.protobuf.Int64Value", "google.protobuf.UInt64Value",
+		"google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+		"google.protobuf.BoolValue", "google.protobuf.StringValue", "google.protobuf.BytesValue":
+		fd := fields.ByName("value")
+		return protoScalarValue(fd, m.Get(fd)), true
+	case "google.protobuf.Struct":
+		rec := make(map[string]interface{})
+		fd := fields.ByName("fields")
+		m.Get(fd).Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			rec[k.String()] = protoMessageValue(v.Message())
+			return true
+		})
+		return rec, true
+	case "google.protobuf.ListValue":
+		list := m.Get(fields.ByName("values")).List()
+		out := make([]interface{}, 0, list.Len())
+		for i := 0; i < list.Len(); i++ {
+			out = append(out, protoMessageValue(list.Get(i).Message()))
+		}
+		return out, true
+	case "google.protobuf.Value":
+		fd := m.WhichOneof(md.Oneofs().ByName("kind"))
+		if fd == nil || fd.Name() == "null_value" {
+			return nil, true
+		}
+		return protoScalarValue(fd, m.Get(fd)), true
+	default:
+		return nil, false
+	}
+}
+
+// protoScalarType returns true for the well known types decoded into values other than record
+func protoScalarType(md protoreflect.MessageDescriptor) bool {
+	switch md.FullName() {
+	case "google.protobuf.Timestamp", "google.protobuf.Duration",
+		"google.protobuf.DoubleValue", "google.protobuf.FloatValue",
+		"google.protobuf.Int64Value", "google.protobuf.UInt64Value",
+		"google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+		"google.protobuf.BoolValue", "google.protobuf.StringValue", "google.protobuf.BytesValue",
+		"google.protobuf.ListValue", "google.protobuf.Value":
+		return true
+	}
+	return false
+}
+
+// protoSchema returns table schema of the message type, seen are the types being mapped
+func protoSchema(md protoreflect.MessageDescriptor, seen map[protoreflect.FullName]bool) (bigquery.Schema, error) {
+	if seen[md.FullName()] {
+		return nil, fmt.Errorf("recursive type %s", md.FullName())
+	}
+	seen[md.FullName()] = true
+	defer delete(seen, md.FullName())
+
+	fields := md.Fields()
+	schema := make(bigquery.Schema, 0, fields.Len())
+	for i := 0; i < fields.Len(); i++ {
+		f, err := protoFieldSchema(fields.Get(i), seen)
+		if err != nil {
+			return nil, err
+		}
+		schema = append(schema, f)
+	}
+	return schema, nil
+}
+
+func protoFieldSchema(fd protoreflect.FieldDescriptor, seen map[protoreflect.FullName]bool) (*bigquery.FieldSchema, error) {
+	f := &bigquery.FieldSchema{Name: string(fd.Name()), Repeated: fd.IsList()}
+	if fd.IsMap() {
+		key, err := protoFieldSchema(fd.MapKey(), seen)
+		if err != nil {
+			return nil, err
+		}
+		value, err := protoFieldSchema(fd.MapValue(), seen)
+		if err != nil {
+			return nil, err
+		}
+		f.Type = bigquery.RecordFieldType
+		f.Repeated = true
+		f.Schema = bigquery.Schema{key, value}
+		return f, nil
+	}
+
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		f.Type = bigquery.BooleanFieldType
+	case protoreflect.EnumKind, protoreflect.StringKind:
+		f.Type = bigquery.StringFieldType
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		f.Type = bigquery.FloatFieldType
+	case protoreflect.BytesKind:
+		f.Type = bigquery.BytesFieldType
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		md := fd.Message()
+		switch md.FullName() {
+		case "google.protobuf.Timestamp":
+			f.Type = bigquery.TimestampFieldType
+		case "google.protobuf.Duration":
+			f.Type = bigquery.StringFieldType
+		case "google.protobuf.Struct", "google.protobuf.ListValue", "google.protobuf.Value":
+			f.Type = jsonFieldType
+		case "google.protobuf.DoubleValue", "google.protobuf.FloatValue",
+			"google.protobuf.Int64Value", "google.protobuf.UInt64Value",
+			"google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+			"google.protobuf.BoolValue", "google.protobuf.StringValue", "google.protobuf.BytesValue":
+			value, err := protoFieldSchema(md.Fields().ByName("value"), seen)
+			if err != nil {
+				return nil, err
+			}
+			f.Type = value.Type
+		default:
+			schema, err := protoSchema(md, seen)
+			if err != nil {
+				return nil, err
+			}
+			f.Type = bigquery.RecordFieldType
+			f.Schema = schema
+		}
+	default:
+		f.Type = bigquery.IntegerFieldType
+	}
+	return f, nil
+}
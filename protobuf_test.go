@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestProtoDecoderMessageType(t *testing.T) {
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(timestamppb.File_google_protobuf_timestamp_proto),
+		protodesc.ToFileDescriptorProto(wrapperspb.File_google_protobuf_wrappers_proto),
+		protodesc.ToFileDescriptorProto(structpb.File_google_protobuf_struct_proto),
+	}}
+	schema, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatalf("error marshaling descriptor set: %v", err)
+	}
+
+	// types decoded into values other than record have no rows to write
+	for _, message := range []string{
+		"google.protobuf.Timestamp",
+		"google.protobuf.StringValue",
+		"google.protobuf.ListValue",
+		"google.protobuf.Value",
+	} {
+		if _, err := newProtoDecoder(schema, message, encodingBinary); err == nil {
+			t.Errorf("%s: expected error", message)
+		}
+	}
+
+	d, err := newProtoDecoder(schema, "google.protobuf.Struct", encodingJSON)
+	if err != nil {
+		t.Fatalf("error creating decoder: %v", err)
+	}
+	rec, err := d.Decode([]byte(`{"name":"test","count":2}`), nil)
+	if err != nil {
+		t.Fatalf("error decoding: %v", err)
+	}
+	if rec["name"] != "test" || fmt.Sprint(rec["count"]) != "2" {
+		t.Errorf("decoded %v, want name and count", rec)
+	}
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
-	"cloud.google.com/go/pubsub"
 	"github.com/mchmarny/gcputil/metric"
 )
 
@@ -14,124 +14,366 @@ const (
 	// custom metrics dimensions
 	invocationMetric = "invocation"
 	messagesMetric   = "message"
+	filteredMetric   = "filtered"
 	durationMetric   = "duration"
+	acceptedMetric   = "accepted"
+	rejectedMetric   = "rejected"
 )
 
-func pump() (count int, err error) {
+// PumpResult summarizes single pump execution
+type PumpResult struct {
+	Messages      int               `json:"messages"`
+	Filtered      int               `json:"filtered"`
+	DroppedFields map[string]int    `json:"dropped_fields,omitempty"`
+	AddedFields   map[string]string `json:"added_fields,omitempty"`
+	InsertResult
+}
+
+func (r *PumpResult) add(ir *InsertResult) {
+	if ir == nil {
+		return
+	}
+	r.Accepted += ir.Accepted
+	r.Rejected += ir.Rejected
+	for table, tr := range ir.Tables {
+		if r.Tables == nil {
+			r.Tables = make(map[string]*TableResult)
+		}
+		t, ok := r.Tables[table]
+		if !ok {
+			t = &TableResult{}
+			r.Tables[table] = t
+		}
+		t.Accepted += tr.Accepted
+		t.Rejected += tr.Rejected
+	}
+}
+
+// pump drains messages of the pipeline from the source, or from the configured one when nil
+func pump(p *Pipeline, src Source) (r *PumpResult, err error) {
 	ctx := context.Background()
 	start := time.Now()
+	logger.Printf("starting pipeline %s", p.Name)
+
+	logger.Printf("creating dead-letter[%s:%s]", cfg.DeadLetter.Type, cfg.DeadLetter.Target)
+	dl, err := NewDeadLetter(ctx, cfg.DeadLetter.Type, cfg.DeadLetter.Target)
+	if err != nil {
+		return nil, fmt.Errorf("dead-letter[%s:%s]: %v",
+			cfg.DeadLetter.Type, cfg.DeadLetter.Target, err)
+	}
+	defer dl.Close()
 
-	logger.Printf("creating pubsub client[%s]", projectID)
-	client, err := pubsub.NewClient(ctx, projectID)
+	proc, err := NewProcessor(ctx, p)
 	if err != nil {
-		return 0, fmt.Errorf("pubsub client[%s]: %v",
-			projectID, err)
+		return nil, fmt.Errorf("processor[%s.%s]: %v",
+			p.Dataset, p.Table, err)
 	}
 
-	logger.Printf("creating importer[%s.%s.%s]",
-		projectID, dsName, tblName)
-	imp, err := NewImportClient(ctx, dsName, tblName)
+	// create the table when missing, without schema file or fixed payload schema
+	// it's created once the first records are sampled
+	var creator *TableCreator
+	inferTable := false
+	if cfg.CreateTable.Enabled && cfg.Sink.Type != sinkTypeMemory {
+		creator, err = NewTableCreator(ctx, p.Dataset, p.Table, cfg.CreateTable.TableSpec)
+		if err != nil {
+			return nil, fmt.Errorf("table creator[%s.%s]: %v",
+				p.Dataset, p.Table, err)
+		}
+		defer creator.Close()
+		exists, err := creator.Exists(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("table[%s.%s]: %v",
+				p.Dataset, p.Table, err)
+		}
+		schema := creator.Schema()
+		if schema == nil {
+			schema = proc.Schema()
+		}
+		if !exists && schema != nil {
+			if _, err := creator.Create(ctx, schema); err != nil {
+				return nil, fmt.Errorf("table[%s.%s]: %v",
+					p.Dataset, p.Table, err)
+			}
+		}
+		inferTable = !exists && schema == nil
+		if inferTable && (cfg.Routing.Mode == routingTemplate || cfg.Routing.Mode == routingRules ||
+			cfg.Routing.Mode == routingEventType) {
+			return nil, fmt.Errorf("%s routing requires table schema file to create table", cfg.Routing.Mode)
+		}
+		if inferTable && cfg.Sink.Type == sinkTypeStorage {
+			return nil, fmt.Errorf("%s sink requires table schema file to create table", cfg.Sink.Type)
+		}
+	}
+
+	router, err := NewTableRouter(cfg.Routing, p.Table, cfg.CreateTable.PartitionType)
 	if err != nil {
-		return 0, fmt.Errorf("bigquery client[%s.%s]: %v",
-			dsName, tblName, err)
+		return nil, fmt.Errorf("router[%s.%s]: %v",
+			p.Dataset, p.Table, err)
+	}
+	if cfg.Routing.Mode == routingPartition && cfg.Sink.Type == sinkTypeStorage {
+		return nil, fmt.Errorf("%s sink does not support partition routing", cfg.Sink.Type)
+	}
+
+	logger.Printf("creating %s sink[%s.%s.%s]",
+		cfg.Sink.Type, projectID, p.Dataset, p.Table)
+	var sink Sink
+	if router != nil {
+		// routed tables get their own sinks, shards are created from the base table
+		sink = NewRouterSink(p.Table, cfg.Sink.Type == sinkTypeLoad, func(ctx context.Context, table string) (Sink, error) {
+			logger.Printf("creating %s sink[%s.%s.%s]", cfg.Sink.Type, projectID, p.Dataset, table)
+			// tables named by message content may not exist
+			switch {
+			case cfg.Sink.Type == sinkTypeMemory || cfg.Routing.Mode == routingPartition:
+			case cfg.Routing.Mode == routingShard:
+				if err := ensureShard(ctx, p.Dataset, p.Table, table); err != nil {
+					return nil, err
+				}
+			default:
+				if err := checkTable(ctx, p.Dataset, table); err != nil {
+					return nil, err
+				}
+			}
+			return NewSink(ctx, cfg.Sink.Type, p.Dataset, table, p.BatchSize)
+		})
+	} else {
+		sink, err = NewSink(ctx, cfg.Sink.Type, p.Dataset, p.Table, p.BatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("sink[%s.%s]: %v",
+				p.Dataset, p.Table, err)
+		}
+	}
+	defer sink.Close()
+
+	// sinks flushed only at the end of the drain hold all messages un-acked until then
+	drainOnly := flushOnDrain(sink)
+	maxOutstanding := p.BatchSize
+	if drainOnly {
+		maxOutstanding = -1
+	}
+
+	if src == nil {
+		logger.Printf("creating %s source[%s]", cfg.Source.Type, p.sourceTarget())
+		src, err = NewSource(ctx, cfg.Source.Type, p.sourceTarget(), maxOutstanding)
+		if err != nil {
+			return nil, fmt.Errorf("source[%s]: %v",
+				p.sourceTarget(), err)
+		}
+	}
+	defer src.Close()
+
+	// coerce records into the table schema unless disabled or there is no table to fetch it from
+	var conv *SchemaConverter
+	if cfg.Schema.Coerce && inferTable {
+		conv = NewSchemaConverter(nil)
+	} else if cfg.Schema.Coerce && cfg.Sink.Type != sinkTypeMemory {
+		logger.Printf("fetching schema[%s.%s]", p.Dataset, p.Table)
+		schema, err := FetchSchema(ctx, p.Dataset, p.Table)
+		if err != nil {
+			return nil, fmt.Errorf("schema[%s.%s]: %v",
+				p.Dataset, p.Table, err)
+		}
+		conv = NewSchemaConverter(schema)
+	}
+
+	// add columns for new fields, only possible when records are coerced into the schema
+	var evolver *SchemaEvolver
+	if cfg.Schema.Evolve != evolveModeOff {
+		if conv == nil {
+			return nil, fmt.Errorf("schema evolution requires schema coercion")
+		}
+		evolver, err = NewSchemaEvolver(ctx, p.Dataset, p.Table, cfg.Schema.Evolve,
+			cfg.Schema.EvolveAllow, cfg.Schema.EvolveDeny, conv)
+		if err != nil {
+			return nil, fmt.Errorf("evolver[%s.%s]: %v",
+				p.Dataset, p.Table, err)
+		}
+		defer evolver.Close()
+	}
+
+	if !inferTable {
+		creator = nil
+	}
+	imp, err := NewImportClient(ctx, p, sink, dl, proc, conv, evolver, creator, router)
+	if err != nil {
+		return nil, fmt.Errorf("importer[%s.%s]: %v",
+			p.Dataset, p.Table, err)
 	}
 	defer imp.Clear()
 
-	logger.Printf("creating pubsub subscription[%s]", subName)
-	s := client.Subscription(subName)
 	inCtx, cancel := context.WithCancel(ctx)
 	var mu sync.Mutex
-	messageCounter := 0
-	totalCounter := 0
+	rowCounter := 0
+	r = &PumpResult{}
 	var innerError error
-	lastMessage := time.Now()
 
-	// this will cancel the sub receive loop if max stall time has reached
-	ticker := time.NewTicker(5 * time.Second)
+	// source tells once it received no messages for max stall, which cancels the receive loop
+	stalled := src.Stalled(inCtx, time.Duration(p.MaxStall)*time.Second)
 	go func() {
-		for c := range ticker.C {
-			elapsed := int(time.Since(lastMessage).Seconds())
-			if elapsed > maxStall {
-				logger.Printf("max stall time reached: %v", c)
-				cancel()
-				ticker.Stop()
-				return
-			}
+		select {
+		case <-stalled:
+			logger.Println("max stall time reached")
+			cancel()
+		case <-inCtx.Done():
 		}
 	}()
 
-	// start pulling messages from subscription
-	receiveErr := s.Receive(inCtx, func(ctx context.Context, msg *pubsub.Message) {
+	// pubsub receive does not return until all delivered messages are acked or nacked
+	// so the leftovers have to be inserted as soon as the receive loop is canceled
+	closed := false
+	var leftoverError error
+	leftoversDone := make(chan struct{})
+	go func() {
+		defer close(leftoversDone)
+		<-inCtx.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		closed = true
+		if innerError != nil {
+			imp.Clear()
+			return
+		}
+		ir, insertErr := imp.Insert(ctx)
+		r.add(ir)
+		leftoverError = insertErr
+	}()
 
-		lastMessage = time.Now()
+	// pushed messages wait for their insert so partial batches are inserted on interval
+	if every := flushInterval(src); every > 0 && !drainOnly {
+		go func() {
+			flushTicker := time.NewTicker(every)
+			defer flushTicker.Stop()
+			for {
+				select {
+				case <-inCtx.Done():
+					return
+				case <-flushTicker.C:
+				}
+				mu.Lock()
+				if !closed && innerError == nil && rowCounter > 0 {
+					logger.Println("flush interval reached")
+					rowCounter = 0
+					ir, insertErr := imp.Insert(ctx)
+					r.add(ir)
+					if insertErr != nil {
+						innerError = insertErr
+						cancel()
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// start pulling messages from source
+	receiveErr := src.Receive(inCtx, func(ctx context.Context, msg *Message) {
 
 		mu.Lock()
 		defer mu.Unlock()
 
-		messageCounter++
-		totalCounter++
+		// receive loop is shutting down, let the message be redelivered
+		if closed || innerError != nil {
+			msg.Nack()
+			return
+		}
+
+		r.Messages++
+
+		// check if max job time has been reached,
+		// current message will still be inserted with the leftovers
+		elapsed := int(time.Since(start).Seconds())
+		if elapsed > p.MaxDuration {
+			logger.Println("max job exec time reached")
+			cancel()
+		}
 
-		// append message to the importer
-		appendErr := imp.Append(msg.Data)
+		// append message to the importer, it will be acked after insert
+		// messages which can't be appended are sent to dead-letter
+		rows, appendErr := imp.Append(ctx, msg)
+		var retryErr *retryError
+		if errors.As(appendErr, &retryErr) {
+			logger.Printf("error on data append, message will be redelivered: %v", appendErr)
+			msg.Nack()
+			return
+		}
 		if appendErr != nil {
 			logger.Printf("error on data append: %v", appendErr)
-			innerError = appendErr
+			r.Rejected++
+			if rejectErr := imp.Reject(ctx, msg, appendErr.Error()); rejectErr != nil {
+				innerError = rejectErr
+				cancel()
+			}
 			return
 		}
-
-		msg.Ack() //TODO: Ack after inserts?
+		// batch size counts rows as batched envelopes expand into many
+		rowCounter += rows
 
 		// check whether time to exec the batch
-		if messageCounter == batchSize {
+		if rowCounter >= p.BatchSize && !drainOnly {
 			logger.Println("batch size reached")
-			messageCounter = 0
-			if insertErr := imp.Insert(ctx); insertErr != nil {
+			rowCounter = 0
+			ir, insertErr := imp.Insert(ctx)
+			r.add(ir)
+			if insertErr != nil {
 				innerError = insertErr
-				return
+				cancel()
 			}
 		}
 
-		// check if max job time has been reached
-		elapsed := int(time.Since(start).Seconds())
-		if elapsed > maxDuration {
-			logger.Println("max job exec time reached")
-			cancel()
-		}
-
 	}) // end revive
 
-	// ticker times no longer needed
-	ticker.Stop()
+	// make sure leftovers are handled even if receive exited on its own
+	cancel()
+	<-leftoversDone
+
+	// messages which were not inserted by choice
+	r.Filtered = imp.Filtered()
+
+	// fields which were not in the table schema
+	if conv != nil {
+		r.DroppedFields = imp.Dropped()
+		if len(r.DroppedFields) > 0 {
+			logger.Printf("dropped unknown fields: %s", droppedSummary(r.DroppedFields))
+		}
+	}
+
+	// columns added (or in dry-run proposed) for new fields
+	if evolver != nil {
+		r.AddedFields = evolver.Added()
+	}
 
 	// receive error
 	if receiveErr != nil {
-		return 0, fmt.Errorf("pubsub subscription[%s] receive: %v",
-			subName, receiveErr)
+		return nil, fmt.Errorf("source[%s] receive: %v",
+			p.sourceTarget(), receiveErr)
 	}
 
 	// error inside of receive handler
 	if innerError != nil {
-		return 0, fmt.Errorf("pubsub receive[%s] process error: %v",
-			subName, innerError)
+		return nil, fmt.Errorf("source receive[%s] process error: %v",
+			p.sourceTarget(), innerError)
 	}
 
 	// insert leftovers
-	if insertErr := imp.Insert(ctx); insertErr != nil {
-		return 0, fmt.Errorf("bigquery insert[%s] error: %v",
-			subName, insertErr)
+	if leftoverError != nil {
+		return nil, fmt.Errorf("bigquery insert[%s] error: %v",
+			p.Subscription, leftoverError)
 	}
 
-	// metrics
+	// metrics, skipped for local file replays
 	totalDuration := time.Since(start).Seconds()
-	if metricErr := submitMetrics(ctx, subName, totalCounter, totalDuration); metricErr != nil {
-		return 0, fmt.Errorf("metrics[%s] error: %v",
-			subName, metricErr)
+	if cfg.Source.Type == sourceTypeFile {
+		logger.Printf("skipping metrics for file source, took %.2f sec", totalDuration)
+		return r, nil
+	}
+	if metricErr := submitMetrics(ctx, p.Subscription, r, totalDuration); metricErr != nil {
+		return nil, fmt.Errorf("metrics[%s] error: %v",
+			p.Subscription, metricErr)
 	}
 
-	return totalCounter, nil
+	return r, nil
 }
 
-func submitMetrics(ctx context.Context, id string, c int, d float64) error {
+func submitMetrics(ctx context.Context, id string, r *PumpResult, d float64) error {
 	m, err := metric.NewClient(ctx)
 	if err != nil {
 		return fmt.Errorf("metric client[%s]: %v", projectID, err)
@@ -143,10 +385,22 @@ func submitMetrics(ctx context.Context, id string, c int, d float64) error {
 		return fmt.Errorf("metric record[%s][%s]: %v", id, invocationMetric, err)
 	}
 
-	if err = m.Publish(ctx, messagesMetric, int64(c), l); err != nil {
+	if err = m.Publish(ctx, messagesMetric, int64(r.Messages), l); err != nil {
 		return fmt.Errorf("metric record[%s][%s]: %v", id, messagesMetric, err)
 	}
 
+	if err = m.Publish(ctx, filteredMetric, int64(r.Filtered), l); err != nil {
+		return fmt.Errorf("metric record[%s][%s]: %v", id, filteredMetric, err)
+	}
+
+	if err = m.Publish(ctx, acceptedMetric, int64(r.Accepted), l); err != nil {
+		return fmt.Errorf("metric record[%s][%s]: %v", id, acceptedMetric, err)
+	}
+
+	if err = m.Publish(ctx, rejectedMetric, int64(r.Rejected), l); err != nil {
+		return fmt.Errorf("metric record[%s][%s]: %v", id, rejectedMetric, err)
+	}
+
 	if err = m.Publish(ctx, durationMetric, d, l); err != nil {
 		return fmt.Errorf("metric record[%s][%s]: %v", id, durationMetric, err)
 	}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPipeline sets config of single pipeline pumping into memory sink
+// with file dead-letter and returns the pipeline
+func testPipeline(t *testing.T) *Pipeline {
+	t.Helper()
+	c, err := LoadConfig(context.Background(), "")
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	// file source skips metrics which need the project
+	c.Source.Type = sourceTypeFile
+	c.Sink.Type = sinkTypeMemory
+	c.DeadLetter = DeadLetterConfig{
+		Type:   deadLetterTypeFile,
+		Target: filepath.Join(t.TempDir(), "dead-letter.json"),
+	}
+	p := c.Pipelines[0]
+	p.Name, p.Subscription, p.Dataset, p.Table = "test", "test", "ds", "tbl"
+
+	prev := cfg
+	cfg = c
+	t.Cleanup(func() {
+		cfg = prev
+		memoryReject = nil
+	})
+	return p
+}
+
+func testMessage(id, data string) *Message {
+	return &Message{
+		ID:          id,
+		Data:        []byte(data),
+		Attributes:  map[string]string{},
+		PublishTime: time.Now().UTC(),
+	}
+}
+
+// deadLettered returns reasons of the dead-lettered messages by their ID
+func deadLettered(t *testing.T) map[string]string {
+	t.Helper()
+	f, err := os.Open(cfg.DeadLetter.Target)
+	if os.IsNotExist(err) {
+		return map[string]string{}
+	}
+	if err != nil {
+		t.Fatalf("error opening dead-letter: %v", err)
+	}
+	defer f.Close()
+	list := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec deadLetterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("error parsing dead-letter record: %v", err)
+		}
+		list[rec.MessageID] = rec.Reason
+	}
+	return list
+}
+
+func sortedIDs(ids []string) []string {
+	out := append([]string(nil), ids...)
+	sort.Strings(out)
+	return out
+}
+
+func TestPump(t *testing.T) {
+	p := testPipeline(t)
+	p.BatchSize = 2
+
+	var written []string
+	memoryReject = func(rec *Record) (bool, error) {
+		switch rec.Values["status"] {
+		case "bad":
+			return false, fmt.Errorf("invalid status")
+		case "busy":
+			return true, fmt.Errorf("table busy")
+		}
+		written = append(written, rec.Msg.ID)
+		return false, nil
+	}
+	src := newMemorySource([]*Message{
+		testMessage("ok-1", `{"status":"ok"}`),
+		testMessage("bad-1", `{"status":"bad"}`),
+		testMessage("ok-2", `{"status":"ok"}`),
+		testMessage("invalid-1", `not json`),
+		testMessage("ok-3", `{"status":"ok"}`),
+		testMessage("busy-1", `{"status":"busy"}`),
+	})
+
+	r, err := pump(p, src)
+	if err != nil {
+		t.Fatalf("error on pump: %v", err)
+	}
+	if r.Messages != 6 || r.Accepted != 3 || r.Rejected != 2 {
+		t.Errorf("got %d messages, %d accepted, %d rejected, want 6, 3, 2",
+			r.Messages, r.Accepted, r.Rejected)
+	}
+	if got := strings.Join(sortedIDs(written), ","); got != "ok-1,ok-2,ok-3" {
+		t.Errorf("written %s, want ok-1,ok-2,ok-3", got)
+	}
+
+	// dead-lettered messages are acked so they are not redelivered
+	if got := strings.Join(sortedIDs(src.acked), ","); got != "bad-1,invalid-1,ok-1,ok-2,ok-3" {
+		t.Errorf("acked %s, want all but busy-1", got)
+	}
+	// records failed for reasons other than the record itself are redelivered
+	if got := strings.Join(src.nacked, ","); got != "busy-1" {
+		t.Errorf("nacked %s, want busy-1", got)
+	}
+
+	dl := deadLettered(t)
+	if len(dl) != 2 {
+		t.Fatalf("dead-lettered %v, want bad-1 and invalid-1 only", dl)
+	}
+	if reason := dl["bad-1"]; !strings.Contains(reason, "invalid status") {
+		t.Errorf("bad-1 dead-lettered with %q, want the sink error", reason)
+	}
+	if _, ok := dl["invalid-1"]; !ok {
+		t.Errorf("invalid-1 not dead-lettered")
+	}
+}
+
+func TestPumpNacksRejectedWithoutDeadLetter(t *testing.T) {
+	p := testPipeline(t)
+	cfg.DeadLetter = DeadLetterConfig{Type: deadLetterTypeNack}
+
+	src := newMemorySource([]*Message{
+		testMessage("ok-1", `{"status":"ok"}`),
+		testMessage("invalid-1", `not json`),
+	})
+	r, err := pump(p, src)
+	if err != nil {
+		t.Fatalf("error on pump: %v", err)
+	}
+	if r.Accepted != 1 || r.Rejected != 1 {
+		t.Errorf("got %d accepted, %d rejected, want 1, 1", r.Accepted, r.Rejected)
+	}
+	// rejected message is left to the subscription's dead-letter policy
+	if got := strings.Join(src.acked, ","); got != "ok-1" {
+		t.Errorf("acked %s, want ok-1", got)
+	}
+	if got := strings.Join(src.nacked, ","); got != "invalid-1" {
+		t.Errorf("nacked %s, want invalid-1", got)
+	}
+}
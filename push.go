@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+var (
+	// issuers of the OIDC tokens pubsub signs push requests with
+	pushIssuers = map[string]bool{
+		"accounts.google.com":         true,
+		"https://accounts.google.com": true,
+	}
+
+	// pumps of the pipelines receiving push deliveries
+	pushers = &pushPumps{sources: make(map[string]*pushSource)}
+)
+
+// pushSource delivers messages pushed to the service to the pump,
+// done is closed once the pump stops receiving them
+type pushSource struct {
+	stallDetector
+	messages chan *Message
+	done     chan struct{}
+	once     sync.Once
+	interval time.Duration
+}
+
+func newPushSource(interval time.Duration) *pushSource {
+	return &pushSource{
+		messages: make(chan *Message),
+		done:     make(chan struct{}),
+		interval: interval,
+	}
+}
+
+// Receive returns once ctx is canceled, messages pushed after that go to the next pump
+func (s *pushSource) Receive(ctx context.Context, f func(ctx context.Context, msg *Message)) error {
+	defer s.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m := <-s.messages:
+			s.touch()
+			f(ctx, m)
+		}
+	}
+}
+
+// FlushInterval is how long pushed messages wait for their batch to fill up
+func (s *pushSource) FlushInterval() time.Duration {
+	return s.interval
+}
+
+func (s *pushSource) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *pushSource) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// pushPumps runs pump of each pipeline receiving push deliveries. Pump is started by
+// the first delivery and, same as pull drain, exits once there were no deliveries
+// for max stall or it ran for max duration, the next delivery starts new one
+type pushPumps struct {
+	mu      sync.Mutex
+	sources map[string]*pushSource
+}
+
+// Deliver hands message to the pump of the pipeline and waits until it's inserted,
+// returns whether it was acked or should be redelivered
+func (pp *pushPumps) Deliver(ctx context.Context, p *Pipeline, msg *Message) (bool, error) {
+	result := make(chan bool, 1)
+	msg.ack = func() { result <- true }
+	msg.nack = func() { result <- false }
+
+	// pump may be exiting as the message arrives, retry once with new one
+	for attempt := 0; attempt < 2; attempt++ {
+		src := pp.source(p)
+		select {
+		case src.messages <- msg:
+			select {
+			case acked := <-result:
+				return acked, nil
+			case <-ctx.Done():
+				// pubsub redelivers the message so it must not be inserted with its batch
+				msg.Cancel()
+				return false, ctx.Err()
+			}
+		case <-src.done:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	return false, fmt.Errorf("pipeline %s pump stopped", p.Name)
+}
+
+// source returns source of the running pump of the pipeline, starting one when none is running
+func (pp *pushPumps) source(p *Pipeline) *pushSource {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if src, ok := pp.sources[p.Name]; ok && !src.stopped() {
+		return src
+	}
+	src := newPushSource(time.Duration(cfg.Push.FlushInterval) * time.Millisecond)
+	pp.sources[p.Name] = src
+	go func() {
+		// pump failing before it receives still has to release waiting deliveries
+		defer src.Close()
+		result, err := pump(p, src)
+		if err != nil {
+			logger.Printf("Error on push pump exec: %v", err)
+			return
+		}
+		logger.Printf("Inserted %d pushed records into %s, rejected %d, filtered %d",
+			result.Accepted, p.Name, result.Rejected, result.Filtered)
+	}()
+	return src
+}
+
+// verifyPush checks that push request carries OIDC token pubsub signed for the configured
+// audience and service account, or the access token when no audience is configured
+func verifyPush(ctx context.Context, authorization, token string) error {
+	if cfg.Push.Audience == "" {
+		if strings.TrimSpace(token) != cfg.Token {
+			return fmt.Errorf("invalid access token")
+		}
+		return nil
+	}
+	const bearer = "Bearer "
+	if len(authorization) <= len(bearer) || !strings.EqualFold(authorization[:len(bearer)], bearer) {
+		return fmt.Errorf("bearer token required")
+	}
+	payload, err := idtoken.Validate(ctx, strings.TrimSpace(authorization[len(bearer):]), cfg.Push.Audience)
+	if err != nil {
+		return err
+	}
+	if !pushIssuers[payload.Issuer] {
+		return fmt.Errorf("invalid token issuer: %s", payload.Issuer)
+	}
+	if cfg.Push.ServiceAccount != "" {
+		email, _ := payload.Claims["email"].(string)
+		verified, _ := payload.Claims["email_verified"].(bool)
+		if email != cfg.Push.ServiceAccount || !verified {
+			return fmt.Errorf("token of %q, want %q", email, cfg.Push.ServiceAccount)
+		}
+	}
+	return nil
+}
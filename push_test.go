@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeliverCanceled(t *testing.T) {
+	p := testPipeline(t)
+	p.MaxStall = 1
+
+	var written []string
+	memoryReject = func(rec *Record) (bool, error) {
+		written = append(written, rec.Msg.ID)
+		return false, nil
+	}
+	// pump is run by the test so that it's done before the config is restored,
+	// its batch is only inserted once it stalls
+	src := newPushSource(time.Minute)
+	pp := &pushPumps{sources: map[string]*pushSource{p.Name: src}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := pump(p, src)
+		done <- err
+	}()
+
+	// request which gave up waiting for the insert leaves its message for redelivery
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	canceled := testMessage("canceled", `{"n":1}`)
+	if _, err := pp.Deliver(ctx, p, canceled); err == nil {
+		t.Fatalf("expected error on canceled delivery")
+	}
+	if !canceled.Canceled() {
+		t.Errorf("message of canceled delivery not canceled")
+	}
+
+	acked, err := pp.Deliver(context.Background(), p, testMessage("ok", `{"n":2}`))
+	if err != nil || !acked {
+		t.Fatalf("got acked %v, error %v, want acked", acked, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("error on pump: %v", err)
+	}
+	if len(written) != 1 || written[0] != "ok" {
+		t.Errorf("written %v, want ok only", written)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	// table routing modes
+	routingNone      = "none"
+	routingPartition = "partition"
+	routingShard     = "shard"
+	routingTemplate  = "template"
+	routingRules     = "rules"
+	routingEventType = "event-type"
+
+	// routing selector prefix of message attributes, anything else is record field
+	attributesSelector = "attributes."
+
+	// max length of routing value in table name
+	maxRoutingValue = 128
+
+	// time after which routed table lookup or sink creation which failed is retried
+	routeRetry = 30 * time.Second
+)
+
+var (
+	// partition decorator formats by partitioning type
+	partitionFormats = map[bigquery.TimePartitioningType]string{
+		bigquery.HourPartitioningType:  "2006010215",
+		bigquery.DayPartitioningType:   "20060102",
+		bigquery.MonthPartitioningType: "200601",
+		bigquery.YearPartitioningType:  "2006",
+	}
+
+	// placeholders in routing template, e.g. {attributes.type}
+	templatePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+	// valid table name, and routing value which becomes part of one once
+	// its dots and dashes (e.g. of event types or host names) are replaced with underscores
+	validTableName    = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+	validRoutingValue = regexp.MustCompile(`^[a-zA-Z0-9_.\-]+$`)
+
+	// errTableNotFound is returned for routed tables which don't exist,
+	// their messages are sent to dead-letter rather than redelivered
+	errTableNotFound = errors.New("table not found")
+)
+
+// TableRouter decides the destination table of each record.
+// SchemaTable returns the table whose schema records routed to table follow
+type TableRouter interface {
+	Route(msg *Message, rec simpleRecord) (table string, err error)
+	SchemaTable(table string) string
+}
+
+// NewTableRouter creates router of the configured mode for the base table, nil for none.
+// Routing field is the dotted path of the record timestamp field, empty to use message publish time,
+// or the event type column for event type routing
+func NewTableRouter(cfg RoutingConfig, table, partitionType string) (TableRouter, error) {
+	switch cfg.Mode {
+	case "", routingNone:
+		return nil, nil
+	case routingShard:
+		return &dateRouter{table: table, field: cfg.Field, format: "_20060102"}, nil
+	case routingPartition:
+		pt := bigquery.TimePartitioningType(strings.ToUpper(partitionType))
+		if pt == "" {
+			pt = bigquery.DayPartitioningType
+		}
+		format, ok := partitionFormats[pt]
+		if !ok {
+			return nil, fmt.Errorf("invalid partition type: %s", partitionType)
+		}
+		return &dateRouter{table: table, field: cfg.Field, format: "$" + format}, nil
+	case routingTemplate:
+		if !templatePlaceholder.MatchString(cfg.Template) {
+			return nil, fmt.Errorf("routing template without placeholders: %q", cfg.Template)
+		}
+		if fixed := templatePlaceholder.ReplaceAllString(cfg.Template, ""); fixed != "" && !validTableName.MatchString(fixed) {
+			return nil, fmt.Errorf("routing template with characters not allowed in table names: %q", cfg.Template)
+		}
+		return &templateRouter{template: cfg.Template}, nil
+	case routingRules:
+		return newRulesRouter(cfg.Rules)
+	case routingEventType:
+		// events go to table suffixed with their type, e.g. table_com_example_created
+		if cfg.Field == "" {
+			return nil, fmt.Errorf("routing field required for %s routing", cfg.Mode)
+		}
+		return &templateRouter{template: table + "_{" + cfg.Field + "}"}, nil
+	default:
+		return nil, fmt.Errorf("invalid table routing: %s", cfg.Mode)
+	}
+}
+
+// dateRouter routes records to partition decorators (table$YYYYMMDD)
+// or date-sharded tables (table_YYYYMMDD) based on the record time in UTC
+type dateRouter struct {
+	table  string
+	field  string
+	format string
+}
+
+func (r *dateRouter) Route(msg *Message, rec simpleRecord) (string, error) {
+	ts := msg.PublishTime
+	if r.field != "" {
+		v, ok := lookupField(rec, r.field)
+		if !ok || v == nil {
+			return "", fmt.Errorf("routing field %s not set", r.field)
+		}
+		t, err := toTimestamp(v)
+		if err != nil {
+			return "", fmt.Errorf("routing field %s: %v", r.field, err)
+		}
+		ts = t
+	}
+	return r.table + ts.UTC().Format(r.format), nil
+}
+
+// SchemaTable of both partitions and shards is the base table
+func (r *dateRouter) SchemaTable(table string) string {
+	return r.table
+}
+
+// templateRouter routes records to the table named by template with placeholders replaced
+// by message attribute or record field values. Values come from messages so they have to be
+// short identifiers, dots and dashes are replaced with underscores
+type templateRouter struct {
+	template string
+}
+
+func (r *templateRouter) Route(msg *Message, rec simpleRecord) (string, error) {
+	var err error
+	table := templatePlaceholder.ReplaceAllStringFunc(r.template, func(p string) string {
+		selector := strings.TrimSpace(p[1 : len(p)-1])
+		v, ok := selectValue(msg, rec, selector)
+		if err != nil {
+			return ""
+		}
+		switch {
+		case !ok || v == "":
+			err = fmt.Errorf("routing value %s not set", selector)
+		case len(v) > maxRoutingValue || !validRoutingValue.MatchString(v):
+			err = fmt.Errorf("invalid routing value %s: %q", selector, v)
+		}
+		return sanitizeTableName(v)
+	})
+	if err != nil {
+		return "", err
+	}
+	return table, nil
+}
+
+func (r *templateRouter) SchemaTable(table string) string {
+	return table
+}
+
+// routingRule routes records whose selected value equals value to table,
+// rule without selector matches all records
+type routingRule struct {
+	selector string
+	value    string
+	table    string
+}
+
+// rulesRouter routes records to the table of the first matching rule
+type rulesRouter struct {
+	rules []*routingRule
+}
+
+// newRulesRouter parses rules in selector=value:table format, *:table rule matches any record
+func newRulesRouter(list []string) (*rulesRouter, error) {
+	r := &rulesRouter{rules: make([]*routingRule, 0)}
+	for _, item := range list {
+		i := strings.LastIndex(item, ":")
+		if i < 0 || strings.TrimSpace(item[i+1:]) == "" {
+			return nil, fmt.Errorf("invalid routing rule, expected selector=value:table: %q", item)
+		}
+		rule := &routingRule{table: strings.TrimSpace(item[i+1:])}
+		if !validTableName.MatchString(rule.table) {
+			return nil, fmt.Errorf("invalid routing rule table: %q", item)
+		}
+		if match := strings.TrimSpace(item[:i]); match != "*" {
+			parts := strings.SplitN(match, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				return nil, fmt.Errorf("invalid routing rule, expected selector=value:table: %q", item)
+			}
+			rule.selector = strings.TrimSpace(parts[0])
+			rule.value = strings.TrimSpace(parts[1])
+		}
+		r.rules = append(r.rules, rule)
+	}
+	if len(r.rules) == 0 {
+		return nil, fmt.Errorf("routing rules required")
+	}
+	return r, nil
+}
+
+func (r *rulesRouter) Route(msg *Message, rec simpleRecord) (string, error) {
+	for _, rule := range r.rules {
+		if rule.selector == "" {
+			return rule.table, nil
+		}
+		if v, ok := selectValue(msg, rec, rule.selector); ok && v == rule.value {
+			return rule.table, nil
+		}
+	}
+	return "", fmt.Errorf("no routing rule matched")
+}
+
+func (r *rulesRouter) SchemaTable(table string) string {
+	return table
+}
+
+// selectValue returns message attribute (attributes.name) or record field (dotted path) as string
+func selectValue(msg *Message, rec simpleRecord, selector string) (string, bool) {
+	if strings.HasPrefix(selector, attributesSelector) {
+		v, ok := msg.Attributes[strings.TrimPrefix(selector, attributesSelector)]
+		return v, ok
+	}
+	v, ok := lookupField(rec, selector)
+	if !ok || v == nil {
+		return "", false
+	}
+	return fmt.Sprint(v), true
+}
+
+// sanitizeTableName replaces dots and dashes of routing value with underscores
+func sanitizeTableName(name string) string {
+	return strings.NewReplacer(".", "_", "-", "_").Replace(name)
+}
+
+// lookupField returns value of the dotted path field in record
+func lookupField(rec simpleRecord, path string) (bigquery.Value, bool) {
+	keys := strings.Split(path, ".")
+	v, ok := rec[keys[0]]
+	for _, key := range keys[1:] {
+		if !ok {
+			return nil, false
+		}
+		m, isMap := v.(map[string]interface{})
+		if !isMap {
+			return nil, false
+		}
+		v, ok = m[key]
+	}
+	return v, ok
+}
+
+// routerSink dispatches records to per-table sinks created on first use.
+// Records of a table whose sink couldn't be created or flushed are retried,
+// unless the table doesn't exist. Failed creation is only retried after routeRetry
+type routerSink struct {
+	mu      sync.Mutex
+	table   string
+	drain   bool
+	newSink func(ctx context.Context, table string) (Sink, error)
+	sinks   map[string]Sink
+	failed  map[string]*routeFailure
+	pending map[string][]*Record
+}
+
+// routeFailure is the error of routed table lookup along with when it failed
+type routeFailure struct {
+	err error
+	at  time.Time
+}
+
+// NewRouterSink creates sink routing records to the sinks created by newSink.
+// Records without table go to the default one, drain tells whether to only flush at the end of the drain
+func NewRouterSink(table string, drain bool, newSink func(ctx context.Context, table string) (Sink, error)) Sink {
+	return &routerSink{
+		table:   table,
+		drain:   drain,
+		newSink: newSink,
+		sinks:   make(map[string]Sink),
+		failed:  make(map[string]*routeFailure),
+		pending: make(map[string][]*Record),
+	}
+}
+
+func (s *routerSink) FlushOnDrain() bool {
+	return s.drain
+}
+
+func (s *routerSink) Append(ctx context.Context, rec *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table := rec.Table
+	if table == "" {
+		table = s.table
+	}
+	sink, err := s.sinkFor(ctx, table)
+	if errors.Is(err, errTableNotFound) {
+		return err
+	}
+	s.pending[table] = append(s.pending[table], rec)
+	if err != nil {
+		// not the record's fault, it is retried when flushed
+		return nil
+	}
+	return sink.Append(ctx, rec)
+}
+
+// sinkFor returns sink of the table, creating it on first use
+func (s *routerSink) sinkFor(ctx context.Context, table string) (Sink, error) {
+	if sink, ok := s.sinks[table]; ok {
+		return sink, nil
+	}
+	if f, ok := s.failed[table]; ok && time.Since(f.at) < routeRetry {
+		return nil, f.err
+	}
+	sink, err := s.newSink(ctx, table)
+	if err != nil {
+		logger.Printf("error creating sink[%s]: %v", table, err)
+		s.failed[table] = &routeFailure{err: err, at: time.Now()}
+		return nil, err
+	}
+	delete(s.failed, table)
+	s.sinks[table] = sink
+	return sink, nil
+}
+
+// Flush flushes sinks of all tables, records of the tables which failed to flush
+// and records appended before their sink was created are marked for retry
+func (s *routerSink) Flush(ctx context.Context) ([]*RecordResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() {
+		s.pending = make(map[string][]*Record)
+	}()
+
+	results := make([]*RecordResult, 0)
+	for table, records := range s.pending {
+		var tableResults []*RecordResult
+		err := fmt.Errorf("sink not created")
+		if f, ok := s.failed[table]; ok {
+			err = fmt.Errorf("sink not created: %v", f.err)
+		}
+		if sink, ok := s.sinks[table]; ok {
+			tableResults, err = sink.Flush(ctx)
+		}
+		if err != nil {
+			logger.Printf("error flushing table %s: %v", table, err)
+			for _, rec := range records {
+				results = append(results, &RecordResult{Record: rec, Err: err, Retry: true})
+			}
+			continue
+		}
+		results = append(results, tableResults...)
+		reported := make(map[*Record]bool, len(tableResults))
+		for _, res := range tableResults {
+			reported[res.Record] = true
+		}
+		for _, rec := range records {
+			if !reported[rec] {
+				results = append(results, &RecordResult{Record: rec, Err: fmt.Errorf("record not written"), Retry: true})
+			}
+		}
+	}
+	return results, nil
+}
+
+func (s *routerSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for table, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			logger.Printf("error closing sink[%s]: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// checkTable returns errTableNotFound when routed table doesn't exist
+func checkTable(ctx context.Context, ds, table string) error {
+	client, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return fmt.Errorf("bigquery client[%s]: %v", projectID, err)
+	}
+	defer client.Close()
+
+	if _, err := client.Dataset(ds).Table(table).Metadata(ctx); err != nil {
+		if isAPIError(err, http.StatusNotFound) {
+			return fmt.Errorf("table[%s.%s]: %w", ds, table, errTableNotFound)
+		}
+		return fmt.Errorf("table metadata[%s.%s]: %v", ds, table, err)
+	}
+	return nil
+}
+
+// ensureShard creates date-sharded table when it doesn't exist
+// using the schema, partitioning, and clustering of the base table
+func ensureShard(ctx context.Context, ds, base, shard string) error {
+	client, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return fmt.Errorf("bigquery client[%s]: %v", projectID, err)
+	}
+	defer client.Close()
+
+	t := client.Dataset(ds).Table(shard)
+	if _, err := t.Metadata(ctx); err == nil {
+		return nil
+	} else if !isAPIError(err, http.StatusNotFound) {
+		return fmt.Errorf("table metadata[%s.%s]: %v", ds, shard, err)
+	}
+
+	meta, err := client.Dataset(ds).Table(base).Metadata(ctx)
+	if err != nil {
+		return fmt.Errorf("table metadata[%s.%s]: %v", ds, base, err)
+	}
+	err = t.Create(ctx, &bigquery.TableMetadata{
+		Schema:           meta.Schema,
+		TimePartitioning: meta.TimePartitioning,
+		Clustering:       meta.Clustering,
+	})
+	if err != nil {
+		if isAPIError(err, http.StatusConflict) {
+			return nil
+		}
+		return fmt.Errorf("table create[%s.%s]: %v", ds, shard, err)
+	}
+	logger.Printf("created shard %s.%s", ds, shard)
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTemplateRouterValues(t *testing.T) {
+	r, err := NewTableRouter(RoutingConfig{Mode: routingTemplate, Template: "events_{attributes.type}"}, "events", "")
+	if err != nil {
+		t.Fatalf("error creating router: %v", err)
+	}
+	tests := map[string]string{
+		"click":                    "events_click",
+		"com.example.order-placed": "events_com_example_order_placed",
+		"":                         "",
+		"a b":                      "",
+		"x`; DROP":                 "",
+		string(make([]byte, 200)):  "",
+	}
+	for value, want := range tests {
+		msg := &Message{Attributes: map[string]string{"type": value}}
+		table, err := r.Route(msg, simpleRecord{})
+		if want == "" {
+			if err == nil {
+				t.Errorf("routed %q to %s, want error", value, table)
+			}
+			continue
+		}
+		if err != nil || table != want {
+			t.Errorf("routed %q to %s (%v), want %s", value, table, err, want)
+		}
+	}
+
+	if _, err := NewTableRouter(RoutingConfig{Mode: routingTemplate, Template: "ds.events_{type}"}, "events", ""); err == nil {
+		t.Errorf("template with invalid table name accepted")
+	}
+	if _, err := NewTableRouter(RoutingConfig{Mode: routingRules, Rules: []string{"type=a:other.table"}}, "events", ""); err == nil {
+		t.Errorf("rule with invalid table name accepted")
+	}
+}
+
+func TestRouterSinkMissingTable(t *testing.T) {
+	ctx := context.Background()
+	created := 0
+	s := NewRouterSink("events", false, func(ctx context.Context, table string) (Sink, error) {
+		created++
+		switch table {
+		case "missing":
+			return nil, fmt.Errorf("table[ds.%s]: %w", table, errTableNotFound)
+		case "busy":
+			return nil, fmt.Errorf("backend error")
+		}
+		return newMemorySink(nil), nil
+	})
+
+	// message routed to missing table fails so it's sent to dead-letter
+	for i := 0; i < 3; i++ {
+		if err := s.Append(ctx, &Record{Table: "missing"}); !errors.Is(err, errTableNotFound) {
+			t.Fatalf("got %v appending to missing table, want table not found", err)
+		}
+	}
+	// other failures are retried
+	if err := s.Append(ctx, &Record{Table: "busy"}); err != nil {
+		t.Fatalf("error appending to busy table: %v", err)
+	}
+	if err := s.Append(ctx, &Record{Table: "events"}); err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+	// failed creation is not repeated for every record
+	if created != 3 {
+		t.Errorf("sinks created %d times, want 3", created)
+	}
+
+	results, err := s.Flush(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, r := range results {
+		if r.Record.Table == "busy" && (r.Err == nil || !r.Retry) {
+			t.Errorf("busy table record not retried: %v", r.Err)
+		}
+		if r.Record.Table == "events" && r.Err != nil {
+			t.Errorf("events table record failed: %v", r.Err)
+		}
+	}
+}
+
+func TestRouterSinkRetriesRecordsBeforeSink(t *testing.T) {
+	ctx := context.Background()
+	fail := true
+	s := NewRouterSink("events", false, func(ctx context.Context, table string) (Sink, error) {
+		if fail {
+			return nil, fmt.Errorf("backend error")
+		}
+		return newMemorySink(nil), nil
+	}).(*routerSink)
+
+	early := &Record{ID: "early"}
+	if err := s.Append(ctx, early); err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+	// sink is created for the next record once the failure is old enough to retry
+	fail = false
+	s.failed["events"].at = time.Time{}
+	if err := s.Append(ctx, &Record{ID: "late"}); err != nil {
+		t.Fatalf("error appending: %v", err)
+	}
+
+	results, err := s.Flush(ctx)
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, r := range results {
+		if r.Record == early && (r.Err == nil || !r.Retry) {
+			t.Errorf("record appended before sink not retried: %v", r.Err)
+		}
+		if r.Record != early && r.Err != nil {
+			t.Errorf("record %s failed: %v", r.Record.ID, r.Err)
+		}
+	}
+}
+
+func TestDateRouter(t *testing.T) {
+	msg := &Message{PublishTime: time.Date(2022, 3, 4, 23, 30, 0, 0, time.FixedZone("PST", -8*3600))}
+	rec := simpleRecord{"event": map[string]interface{}{"ts": "2021-12-31T23:59:59Z"}}
+
+	tests := []struct {
+		name      string
+		cfg       RoutingConfig
+		partition string
+		want      string
+	}{
+		{"shard by publish time", RoutingConfig{Mode: routingShard}, "", "events_20220305"},
+		{"shard by field", RoutingConfig{Mode: routingShard, Field: "event.ts"}, "", "events_20211231"},
+		{"day partition", RoutingConfig{Mode: routingPartition}, "", "events$20220305"},
+		{"hour partition", RoutingConfig{Mode: routingPartition}, "hour", "events$2022030507"},
+		{"month partition by field", RoutingConfig{Mode: routingPartition, Field: "event.ts"}, "MONTH", "events$202112"},
+		{"year partition", RoutingConfig{Mode: routingPartition}, "YEAR", "events$2022"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewTableRouter(tt.cfg, "events", tt.partition)
+			if err != nil {
+				t.Fatalf("error creating router: %v", err)
+			}
+			table, err := r.Route(msg, rec)
+			if err != nil {
+				t.Fatalf("error routing: %v", err)
+			}
+			if table != tt.want {
+				t.Errorf("routed to %s, want %s", table, tt.want)
+			}
+			// partitions and shards share the base table schema
+			if got := r.SchemaTable(table); got != "events" {
+				t.Errorf("got schema table %s, want events", got)
+			}
+		})
+	}
+
+	r, _ := NewTableRouter(RoutingConfig{Mode: routingShard, Field: "ts"}, "events", "")
+	for _, rec := range []simpleRecord{{}, {"ts": nil}, {"ts": "soon"}} {
+		if _, err := r.Route(msg, rec); err == nil {
+			t.Errorf("routing %v: expected error", rec)
+		}
+	}
+	if _, err := NewTableRouter(RoutingConfig{Mode: routingPartition}, "events", "week"); err == nil {
+		t.Errorf("expected error for invalid partition type")
+	}
+}
+
+func TestRulesRouter(t *testing.T) {
+	r, err := NewTableRouter(RoutingConfig{Mode: routingRules, Rules: []string{
+		"attributes.source=web:web_events",
+		"order.status=paid:orders",
+		"*:other_events",
+	}}, "events", "")
+	if err != nil {
+		t.Fatalf("error creating router: %v", err)
+	}
+	tests := []struct {
+		attrs map[string]string
+		rec   simpleRecord
+		want  string
+	}{
+		{map[string]string{"source": "web"}, simpleRecord{"order": map[string]interface{}{"status": "paid"}}, "web_events"},
+		{nil, simpleRecord{"order": map[string]interface{}{"status": "paid"}}, "orders"},
+		{map[string]string{"source": "app"}, simpleRecord{}, "other_events"},
+	}
+	for _, tt := range tests {
+		table, err := r.Route(&Message{Attributes: tt.attrs}, tt.rec)
+		if err != nil || table != tt.want {
+			t.Errorf("routed %v %v to %s (%v), want %s", tt.attrs, tt.rec, table, err, tt.want)
+		}
+	}
+
+	// records matching no rule fail without catch-all rule
+	r, _ = NewTableRouter(RoutingConfig{Mode: routingRules, Rules: []string{"type=a:a_events"}}, "events", "")
+	if table, err := r.Route(&Message{}, simpleRecord{"type": "b"}); err == nil {
+		t.Errorf("routed to %s, want error", table)
+	}
+	for _, rules := range [][]string{nil, {"type=a"}, {"=a:table"}, {"type=a:"}} {
+		if _, err := NewTableRouter(RoutingConfig{Mode: routingRules, Rules: rules}, "events", ""); err == nil {
+			t.Errorf("rules %q: expected error", rules)
+		}
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+const (
+	// JSON column type, not yet defined in the bigquery client
+	jsonFieldType bigquery.FieldType = "JSON"
+)
+
+var (
+	// timestamp formats tried in order when coercing strings into TIMESTAMP columns,
+	// formats without zone are assumed to be in UTC
+	timestampFormats = []string{
+		time.RFC3339Nano,
+		"2006-01-02 15:04:05.999999999Z07:00",
+		"2006-01-02 15:04:05.999999999 Z07:00",
+		"2006-01-02 15:04:05.999999999 MST",
+		"2006-01-02T15:04:05.999999999",
+		"2006-01-02 15:04:05.999999999",
+		"2006-01-02",
+		time.RFC1123Z,
+		time.RFC1123,
+		time.RFC850,
+		time.ANSIC,
+		time.UnixDate,
+	}
+)
+
+// FetchSchema retrieves the schema of ds.table
+func FetchSchema(ctx context.Context, ds, table string) (bigquery.Schema, error) {
+	client, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("bigquery client[%s]: %v", projectID, err)
+	}
+	defer client.Close()
+
+	meta, err := client.Dataset(ds).Table(table).Metadata(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("table metadata[%s.%s]: %w", ds, table, err)
+	}
+	return meta.Schema, nil
+}
+
+// SchemaConverter coerces decoded records into the table schema.
+// Fields not in the schema are dropped and counted by their dotted path
+type SchemaConverter struct {
+	mu      sync.Mutex
+	schema  bigquery.Schema
+	dropped map[string]int
+}
+
+// NewSchemaConverter creates converter for the provided table schema
+func NewSchemaConverter(schema bigquery.Schema) *SchemaConverter {
+	return &SchemaConverter{
+		schema:  schema,
+		dropped: make(map[string]int),
+	}
+}
+
+// Convert returns new record with values coerced to their column types
+// and keys matching the column names, column names are case insensitive
+func (c *SchemaConverter) Convert(rec simpleRecord) (simpleRecord, error) {
+	m := make(map[string]interface{}, len(rec))
+	for k, v := range rec {
+		m[k] = v
+	}
+	out, err := c.convertRecord(c.Schema(), m, "")
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Schema returns the schema records are currently coerced into
+func (c *SchemaConverter) Schema() bigquery.Schema {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.schema
+}
+
+// SetSchema replaces the schema, e.g. after columns were added to the table
+func (c *SchemaConverter) SetSchema(schema bigquery.Schema) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schema = schema
+}
+
+// Dropped returns the number of times each unknown field was dropped
+func (c *SchemaConverter) Dropped() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := make(map[string]int, len(c.dropped))
+	for k, v := range c.dropped {
+		d[k] = v
+	}
+	return d
+}
+
+func (c *SchemaConverter) drop(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropped[path]++
+}
+
+func (c *SchemaConverter) convertRecord(schema bigquery.Schema, rec map[string]interface{}, prefix string) (simpleRecord, error) {
+	fields := make(map[string]*bigquery.FieldSchema, len(schema))
+	for _, f := range schema {
+		fields[strings.ToLower(f.Name)] = f
+	}
+
+	out := make(simpleRecord, len(rec))
+	for k, v := range rec {
+		path := prefix + k
+		f, ok := fields[strings.ToLower(k)]
+		if !ok {
+			c.drop(path)
+			continue
+		}
+		cv, err := c.convertField(f, v, path)
+		if err != nil {
+			return nil, err
+		}
+		if cv != nil {
+			out[f.Name] = cv
+		}
+	}
+	return out, nil
+}
+
+func (c *SchemaConverter) convertField(f *bigquery.FieldSchema, v bigquery.Value, path string) (bigquery.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if !f.Repeated {
+		return c.convertValue(f, v, path)
+	}
+
+	// single value into repeated column becomes single item list
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	out := make([]bigquery.Value, 0, len(list))
+	for i, item := range list {
+		// nulls are not allowed in arrays
+		if item == nil {
+			continue
+		}
+		cv, err := c.convertValue(f, item, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, cv)
+	}
+	return out, nil
+}
+
+func (c *SchemaConverter) convertValue(f *bigquery.FieldSchema, v bigquery.Value, path string) (bigquery.Value, error) {
+	var cv bigquery.Value
+	var err error
+	switch normalizeFieldType(f.Type) {
+	case bigquery.StringFieldType:
+		cv, err = toString(v)
+	case bigquery.GeographyFieldType, jsonFieldType:
+		cv, err = toJSONString(v)
+	case bigquery.BytesFieldType:
+		cv, err = toBytes(v)
+	case bigquery.IntegerFieldType:
+		cv, err = toInteger(v)
+	case bigquery.FloatFieldType:
+		cv, err = toFloat(v)
+	case bigquery.NumericFieldType:
+		cv, err = toNumeric(v, bigquery.NumericScaleDigits)
+	case bigquery.BigNumericFieldType:
+		cv, err = toNumeric(v, bigquery.BigNumericScaleDigits)
+	case bigquery.BooleanFieldType:
+		cv, err = toBool(v)
+	case bigquery.TimestampFieldType:
+		cv, err = toTimestamp(v)
+	case bigquery.DateFieldType:
+		cv, err = toDate(v)
+	case bigquery.DateTimeFieldType:
+		cv, err = toDateTime(v)
+	case bigquery.TimeFieldType:
+		cv, err = toTime(v)
+	case bigquery.RecordFieldType:
+		var m map[string]interface{}
+		if m, err = toMap(v); err == nil {
+			cv, err = c.convertRecord(f.Schema, m, path+".")
+		}
+	default:
+		cv = v
+	}
+	if err != nil {
+		return nil, fmt.Errorf("field %s (%s): %v", path, f.Type, err)
+	}
+	return cv, nil
+}
+
+// normalizeFieldType maps standard SQL type names onto their legacy equivalents
+func normalizeFieldType(t bigquery.FieldType) bigquery.FieldType {
+	switch strings.ToUpper(string(t)) {
+	case "INT64":
+		return bigquery.IntegerFieldType
+	case "FLOAT64":
+		return bigquery.FloatFieldType
+	case "BOOL":
+		return bigquery.BooleanFieldType
+	case "STRUCT":
+		return bigquery.RecordFieldType
+	case "DECIMAL":
+		return bigquery.NumericFieldType
+	case "BIGDECIMAL":
+		return bigquery.BigNumericFieldType
+	default:
+		return bigquery.FieldType(strings.ToUpper(string(t)))
+	}
+}
+
+func toString(v bigquery.Value) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case json.Number:
+		return t.String(), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	default:
+		return toJSONString(v)
+	}
+}
+
+// toJSONString keeps strings as they are and serializes everything else as JSON
+func toJSONString(v bigquery.Value) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// toBytes decodes base64 strings, bytes are always base64 encoded in JSON
+// so anything else is rejected rather than guessed
+func toBytes(v bigquery.Value) ([]byte, error) {
+	switch t := v.(type) {
+	case []byte:
+		return t, nil
+	case string:
+		b, err := base64.StdEncoding.DecodeString(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 value: %v", err)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("bytes expected as base64 string, got %T", v)
+	}
+}
+
+func toInteger(v bigquery.Value) (int64, error) {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return 0, err
+		}
+		return floatToInteger(f)
+	case float64:
+		return floatToInteger(t)
+	case string:
+		s := strings.TrimSpace(t)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid integer: %q", t)
+		}
+		return floatToInteger(f)
+	case bool:
+		if t {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("invalid integer: %v", v)
+	}
+}
+
+func floatToInteger(f float64) (int64, error) {
+	if f != math.Trunc(f) || f > math.MaxInt64 || f < math.MinInt64 {
+		return 0, fmt.Errorf("invalid integer: %v", f)
+	}
+	return int64(f), nil
+}
+
+func toFloat(v bigquery.Value) (float64, error) {
+	switch t := v.(type) {
+	case json.Number:
+		return t.Float64()
+	case float64:
+		return t, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid float: %q", t)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("invalid float: %v", v)
+	}
+}
+
+// toNumeric parses numeric value and rounds it to the provided scale
+func toNumeric(v bigquery.Value, scale int) (*big.Rat, error) {
+	var s string
+	switch t := v.(type) {
+	case json.Number:
+		s = t.String()
+	case float64:
+		s = strconv.FormatFloat(t, 'f', -1, 64)
+	case string:
+		s = strings.TrimSpace(t)
+	default:
+		return nil, fmt.Errorf("invalid numeric: %v", v)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid numeric: %q", s)
+	}
+	r, _ = new(big.Rat).SetString(r.FloatString(scale))
+	return r, nil
+}
+
+func toBool(v bigquery.Value) (bool, error) {
+	switch t := v.(type) {
+	case bool:
+		return t, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(t))
+		if err != nil {
+			return false, fmt.Errorf("invalid boolean: %q", t)
+		}
+		return b, nil
+	case json.Number, float64:
+		f, err := toFloat(t)
+		if err != nil || (f != 0 && f != 1) {
+			return false, fmt.Errorf("invalid boolean: %v", v)
+		}
+		return f == 1, nil
+	default:
+		return false, fmt.Errorf("invalid boolean: %v", v)
+	}
+}
+
+// toTimestamp parses timestamp from one of the supported string formats
+// or from numeric epoch in seconds, milliseconds, microseconds or nanoseconds
+func toTimestamp(v bigquery.Value) (time.Time, error) {
+	switch t := v.(type) {
+	case string:
+		s := strings.TrimSpace(t)
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return epochToTime(json.Number(s))
+		}
+		for _, f := range timestampFormats {
+			if ts, err := time.Parse(f, s); err == nil {
+				return ts.UTC(), nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid timestamp: %q", t)
+	case json.Number:
+		return epochToTime(t)
+	case float64:
+		return epochToTime(json.Number(strconv.FormatFloat(t, 'f', -1, 64)))
+	default:
+		return time.Time{}, fmt.Errorf("invalid timestamp: %v", v)
+	}
+}
+
+// epochToTime guesses the epoch unit based on its magnitude
+func epochToTime(n json.Number) (time.Time, error) {
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid epoch: %v", n)
+	}
+	abs := math.Abs(f)
+	switch {
+	case abs < 1e11:
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	case abs < 1e14:
+		return time.UnixMilli(int64(f)).UTC(), nil
+	case abs < 1e17:
+		return time.UnixMicro(int64(f)).UTC(), nil
+	default:
+		i, err := n.Int64()
+		if err != nil {
+			i = int64(f)
+		}
+		return time.Unix(0, i).UTC(), nil
+	}
+}
+
+func toDate(v bigquery.Value) (civil.Date, error) {
+	if s, ok := v.(string); ok {
+		if d, err := civil.ParseDate(strings.TrimSpace(s)); err == nil {
+			return d, nil
+		}
+	}
+	ts, err := toTimestamp(v)
+	if err != nil {
+		return civil.Date{}, fmt.Errorf("invalid date: %v", v)
+	}
+	return civil.DateOf(ts), nil
+}
+
+func toDateTime(v bigquery.Value) (civil.DateTime, error) {
+	if s, ok := v.(string); ok {
+		s = strings.Replace(strings.TrimSpace(s), " ", "T", 1)
+		if dt, err := civil.ParseDateTime(s); err == nil {
+			return dt, nil
+		}
+	}
+	ts, err := toTimestamp(v)
+	if err != nil {
+		return civil.DateTime{}, fmt.Errorf("invalid datetime: %v", v)
+	}
+	return civil.DateTimeOf(ts), nil
+}
+
+func toTime(v bigquery.Value) (civil.Time, error) {
+	s, ok := v.(string)
+	if !ok {
+		return civil.Time{}, fmt.Errorf("invalid time: %v", v)
+	}
+	t, err := civil.ParseTime(strings.TrimSpace(s))
+	if err != nil {
+		return civil.Time{}, fmt.Errorf("invalid time: %q", s)
+	}
+	return t, nil
+}
+
+// toMap accepts objects as well as strings containing JSON object
+func toMap(v bigquery.Value) (map[string]interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t, nil
+	case string:
+		m := make(map[string]interface{})
+		d := json.NewDecoder(strings.NewReader(t))
+		d.UseNumber()
+		if err := d.Decode(&m); err != nil {
+			return nil, fmt.Errorf("invalid record: %q", t)
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("invalid record: %v", v)
+	}
+}
+
+// toJSONValue encodes coerced values in the format expected by
+// streaming inserts and load jobs, other values are returned as is
+func toJSONValue(v bigquery.Value) bigquery.Value {
+	switch t := v.(type) {
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano)
+	case civil.Date:
+		return t.String()
+	case civil.DateTime:
+		return bigquery.CivilDateTimeString(t)
+	case civil.Time:
+		return bigquery.CivilTimeString(t)
+	case *big.Rat:
+		return ratString(t)
+	case simpleRecord:
+		return toJSONValues(t)
+	case []bigquery.Value:
+		out := make([]bigquery.Value, len(t))
+		for i, item := range t {
+			out[i] = toJSONValue(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// toJSONValues encodes each of the record values using toJSONValue
+func toJSONValues(rec simpleRecord) simpleRecord {
+	out := make(simpleRecord, len(rec))
+	for k, v := range rec {
+		out[k] = toJSONValue(v)
+	}
+	return out
+}
+
+// ratString formats numeric without trailing zeros
+func ratString(r *big.Rat) string {
+	s := r.FloatString(bigquery.BigNumericScaleDigits)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// droppedSummary formats dropped field counts for logging
+func droppedSummary(dropped map[string]int) string {
+	keys := make([]string, 0, len(dropped))
+	for k := range dropped {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s:%d", k, dropped[k]))
+	}
+	return strings.Join(parts, ", ")
+}
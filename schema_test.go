@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestSchemaConverter(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "ID", Type: bigquery.IntegerFieldType},
+		{Name: "score", Type: "FLOAT64"},
+		{Name: "price", Type: bigquery.NumericFieldType},
+		{Name: "ok", Type: bigquery.BooleanFieldType},
+		{Name: "ts", Type: bigquery.TimestampFieldType},
+		{Name: "day", Type: bigquery.DateFieldType},
+		{Name: "at", Type: bigquery.DateTimeFieldType},
+		{Name: "note", Type: bigquery.StringFieldType},
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+		{Name: "geo", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "lat", Type: bigquery.FloatFieldType},
+		}},
+	}
+	c := NewSchemaConverter(schema)
+	rec := simpleRecord{
+		"id":    "42",
+		"score": json.Number("1.5"),
+		"price": "12.345",
+		"ok":    json.Number("1"),
+		"ts":    json.Number("1640995200000"),
+		"day":   "2022-01-02T10:00:00Z",
+		"at":    "2022-01-02 03:04:05",
+		"note":  map[string]interface{}{"a": "b"},
+		"tags":  "single",
+		"geo":   `{"lat": 1.5, "lon": 2}`,
+		"extra": "x",
+		"empty": nil,
+	}
+	got, err := c.Convert(rec)
+	if err != nil {
+		t.Fatalf("error converting: %v", err)
+	}
+	want := simpleRecord{
+		"ID":    int64(42),
+		"score": 1.5,
+		"price": "12.345",
+		"ok":    true,
+		"ts":    "2022-01-01T00:00:00Z",
+		"day":   "2022-01-02",
+		"at":    "2022-01-02 03:04:05",
+		"note":  `{"a":"b"}`,
+		"tags":  []bigquery.Value{"single"},
+		"geo":   simpleRecord{"lat": 1.5},
+	}
+	if got := toJSONValues(got); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	wantDropped := map[string]int{"extra": 1, "empty": 1, "geo.lon": 1}
+	if d := c.Dropped(); !reflect.DeepEqual(d, wantDropped) {
+		t.Errorf("got dropped %v, want %v", d, wantDropped)
+	}
+
+	for field, v := range map[string]interface{}{
+		"id":    "1.5",
+		"ok":    "maybe",
+		"ts":    "yesterday",
+		"geo":   "[1]",
+		"score": true,
+	} {
+		if _, err := c.Convert(simpleRecord{field: v}); err == nil {
+			t.Errorf("%s: expected error for %v", field, v)
+		}
+	}
+}
+
+func TestToBytes(t *testing.T) {
+	b, err := toBytes("aGVsbG8=")
+	if err != nil || string(b) != "hello" {
+		t.Errorf("got %q, %v, want hello", b, err)
+	}
+	// plain strings are not guessed to be text
+	for _, v := range []interface{}{"hello world", "abc", 42} {
+		if b, err := toBytes(v); err == nil {
+			t.Errorf("got %q for %v, want error", b, v)
+		}
+	}
+}
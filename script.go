@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	starjson "go.starlark.net/lib/json"
+	starmath "go.starlark.net/lib/math"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+const (
+	// max execution steps of loading the script and of each call, bounds CPU use
+	// of scripts which run too long for the timeout to be noticed in time
+	maxScriptSteps = 10000000
+)
+
+// Script runs Starlark function on each record returning zero or more records.
+// Scripts are sandboxed, they can't load modules or access files or network,
+// and both loading and each call are cancelled once they run longer than the timeout
+// or take more than maxScriptSteps steps
+type Script struct {
+	name    string
+	fn      starlark.Callable
+	timeout time.Duration
+}
+
+// NewScript loads script file (local path or gs://bucket/object) and looks up its function,
+// nil when no script file is set
+func NewScript(ctx context.Context, cfg ScriptConfig) (*Script, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	if cfg.Function == "" {
+		return nil, fmt.Errorf("script function required")
+	}
+	if cfg.Timeout <= 0 {
+		return nil, fmt.Errorf("script timeout must be positive, got %d", cfg.Timeout)
+	}
+	src, err := readFile(ctx, cfg.File)
+	if err != nil {
+		return nil, fmt.Errorf("script file[%s]: %v", cfg.File, err)
+	}
+
+	timeout := time.Duration(cfg.Timeout) * time.Millisecond
+	thread, stop := newScriptThread(cfg.File, timeout)
+	globals, err := starlark.ExecFile(thread, cfg.File, src, starlark.StringDict{
+		"json": starjson.Module,
+		"math": starmath.Module,
+	})
+	stop()
+	if err != nil {
+		return nil, fmt.Errorf("script file[%s] load: %v", cfg.File, err)
+	}
+	fn, ok := globals[cfg.Function].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("script file[%s]: function %s not defined", cfg.File, cfg.Function)
+	}
+	return &Script{
+		name:    cfg.File,
+		fn:      fn,
+		timeout: timeout,
+	}, nil
+}
+
+// newScriptThread creates thread without module loading, with print going to the log,
+// and limited to maxScriptSteps steps. Thread is cancelled after timeout unless stop is called
+func newScriptThread(name string, timeout time.Duration) (thread *starlark.Thread, stop func()) {
+	thread = &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			logger.Printf("script[%s]: %s", name, msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	timer := time.AfterFunc(timeout, func() {
+		thread.Cancel(fmt.Sprintf("timeout after %v", timeout))
+	})
+	return thread, func() { timer.Stop() }
+}
+
+// Run calls the script function with record and message metadata.
+// Function returns None to skip the message, dict for single record, or list of dicts
+func (s *Script) Run(msg *Message, rec simpleRecord) ([]simpleRecord, error) {
+	in := make(map[string]interface{}, len(rec))
+	for k, v := range rec {
+		in[k] = v
+	}
+	record, err := toStarlark(in)
+	if err != nil {
+		return nil, fmt.Errorf("script input: %v", err)
+	}
+	attrs := starlark.NewDict(len(msg.Attributes))
+	for k, v := range msg.Attributes {
+		if err := attrs.SetKey(starlark.String(k), starlark.String(v)); err != nil {
+			return nil, err
+		}
+	}
+	meta := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"id":           starlark.String(msg.ID),
+		"attributes":   attrs,
+		"publish_time": starlark.String(msg.PublishTime.UTC().Format(time.RFC3339Nano)),
+		"ordering_key": starlark.String(msg.OrderingKey),
+	})
+
+	thread, stop := newScriptThread(s.name, s.timeout)
+	defer stop()
+
+	out, err := starlark.Call(thread, s.fn, starlark.Tuple{record, meta}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("script[%s]: %v", s.name, err)
+	}
+	return scriptRecords(out)
+}
+
+// scriptRecords converts the script function result into records
+func scriptRecords(out starlark.Value) ([]simpleRecord, error) {
+	var items []starlark.Value
+	switch t := out.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case *starlark.Dict:
+		items = []starlark.Value{t}
+	case *starlark.List:
+		for i := 0; i < t.Len(); i++ {
+			items = append(items, t.Index(i))
+		}
+	case starlark.Tuple:
+		items = t
+	default:
+		return nil, fmt.Errorf("script result must be None, dict, or list of dicts, got %s", out.Type())
+	}
+
+	records := make([]simpleRecord, 0, len(items))
+	for i, item := range items {
+		d, ok := item.(*starlark.Dict)
+		if !ok {
+			return nil, fmt.Errorf("script result item %d must be dict, got %s", i, item.Type())
+		}
+		v, err := fromStarlark(d)
+		if err != nil {
+			return nil, fmt.Errorf("script result item %d: %v", i, err)
+		}
+		rec := make(simpleRecord)
+		for k, fv := range v.(map[string]interface{}) {
+			rec[k] = fv
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// toStarlark converts decoded JSON value into Starlark value
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch t := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(t), nil
+	case string:
+		return starlark.String(t), nil
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return starlark.MakeInt64(n), nil
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return starlark.Float(f), nil
+	case float64:
+		return starlark.Float(t), nil
+	case map[string]interface{}:
+		d := starlark.NewDict(len(t))
+		for k, item := range t {
+			sv, err := toStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			if err := d.SetKey(starlark.String(k), sv); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+	case []interface{}:
+		list := make([]starlark.Value, 0, len(t))
+		for _, item := range t {
+			sv, err := toStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, sv)
+		}
+		return starlark.NewList(list), nil
+	default:
+		return nil, fmt.Errorf("unsupported value type: %T", v)
+	}
+}
+
+// fromStarlark converts Starlark value back into decoded JSON form
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch t := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(t), nil
+	case starlark.String:
+		return string(t), nil
+	case starlark.Int:
+		return json.Number(t.String()), nil
+	case starlark.Float:
+		f := float64(t)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("invalid number: %v", f)
+		}
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	case *starlark.Dict:
+		m := make(map[string]interface{}, t.Len())
+		for _, item := range t.Items() {
+			k, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("dict keys must be strings, got %s", item[0].Type())
+			}
+			fv, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			m[string(k)] = fv
+		}
+		return m, nil
+	case starlark.Indexable:
+		list := make([]interface{}, 0, t.Len())
+		for i := 0; i < t.Len(); i++ {
+			fv, err := fromStarlark(t.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, fv)
+		}
+		return list, nil
+	default:
+		return nil, fmt.Errorf("unsupported value type: %s", v.Type())
+	}
+}
+
+// testScript processes each non-empty line of the samples file as message of the pipeline,
+// the first one when no name is set, and writes the resulting records. Returns the number
+// of failed samples. Lines are message data, or messages with attributes (see sampleMessage)
+func testScript(ctx context.Context, path, pipeline string, w io.Writer) (int, error) {
+	b, err := readFile(ctx, path)
+	if err != nil {
+		return 0, fmt.Errorf("samples file[%s]: %v", path, err)
+	}
+	p := cfg.Pipelines[0]
+	if pipeline != "" {
+		p = nil
+		for _, item := range cfg.Pipelines {
+			if item.Name == pipeline {
+				p = item
+			}
+		}
+		if p == nil {
+			return 0, fmt.Errorf("pipeline %s not found", pipeline)
+		}
+	}
+	proc, err := NewProcessor(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	binary := p.Payload.Encoding == encodingBinary && !cfg.CloudEvents.Enabled &&
+		(p.Payload.Format == payloadFormatAvro || p.Payload.Format == payloadFormatProtobuf)
+
+	failed := 0
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(make([]byte, 0, 64*1024), maxFileLineSize)
+	for line := 1; s.Scan(); line++ {
+		data := bytes.TrimSpace(s.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		msg, err := sampleMessage(data, binary)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "line %d: error: %v\n", line, err)
+			continue
+		}
+		msg.ID = fmt.Sprintf("sample-%d", line)
+		records, action, rule, err := proc.Process(msg)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "line %d: error: %v\n", line, err)
+			continue
+		}
+		if action != "" && action != filterActionInsert {
+			if rule == "" {
+				fmt.Fprintf(w, "line %d: filtered (%s) by default action\n", line, action)
+				continue
+			}
+			fmt.Fprintf(w, "line %d: filtered (%s) by rule %q\n", line, action, rule)
+			continue
+		}
+		if len(records) == 0 {
+			fmt.Fprintf(w, "line %d: skipped\n", line)
+			continue
+		}
+		for i, rec := range records {
+			out, err := json.Marshal(rec)
+			if err != nil {
+				return failed, err
+			}
+			fmt.Fprintf(w, "line %d: record %d: %s\n", line, i, out)
+		}
+	}
+	return failed, s.Err()
+}
+
+// sampleMessage creates message of the sample line. Line which is JSON object of only
+// attributes object and optional data is message with these attributes, its string data
+// is used as is and any other data as JSON. Any other line is the message data.
+// Data of binary encoded avro or protobuf payloads is base64 encoded
+func sampleMessage(line []byte, binary bool) (*Message, error) {
+	msg := &Message{
+		Data:        line,
+		Attributes:  make(map[string]string),
+		PublishTime: time.Now(),
+	}
+	var sample map[string]json.RawMessage
+	if err := json.Unmarshal(line, &sample); err == nil && sample["attributes"] != nil &&
+		(len(sample) == 1 || len(sample) == 2 && sample["data"] != nil) {
+		if err := json.Unmarshal(sample["attributes"], &msg.Attributes); err != nil {
+			return nil, fmt.Errorf("invalid sample attributes: %v", err)
+		}
+		msg.Data = nil
+		if raw, ok := sample["data"]; ok {
+			var s string
+			if err := json.Unmarshal(raw, &s); err == nil {
+				msg.Data = []byte(s)
+			} else {
+				msg.Data = raw
+			}
+		}
+	}
+	if binary {
+		b, err := base64.StdEncoding.DecodeString(string(msg.Data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64: %v", err)
+		}
+		msg.Data = b
+	}
+	return msg, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("error writing %s: %v", name, err)
+	}
+	return path
+}
+
+const testScriptSource = `
+def transform(record, message):
+    record["source"] = message.attributes.get("source", "unknown")
+    if record.get("skip"):
+        return None
+    return [dict(id=record["id"], n=i, source=record["source"]) for i in range(record.get("count", 1))]
+`
+
+func TestScriptRun(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewScript(ctx, ScriptConfig{
+		File:     writeTestFile(t, "split.star", testScriptSource),
+		Function: "transform",
+		Timeout:  1000,
+	})
+	if err != nil {
+		t.Fatalf("error loading script: %v", err)
+	}
+	msg := &Message{ID: "1", Attributes: map[string]string{"source": "web"}}
+	records, err := s.Run(msg, simpleRecord{"id": "a", "count": json.Number("3")})
+	if err != nil {
+		t.Fatalf("error running script: %v", err)
+	}
+	if len(records) != 3 || records[2]["n"] != json.Number("2") || records[2]["source"] != "web" {
+		t.Errorf("got records %v, want 3 split ones", records)
+	}
+	if records, err := s.Run(msg, simpleRecord{"id": "a", "skip": true}); err != nil || records != nil {
+		t.Errorf("got records %v (%v), want skipped", records, err)
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	ctx := context.Background()
+	// top level loop is stopped when the script is loaded
+	_, err := NewScript(ctx, ScriptConfig{
+		File:     writeTestFile(t, "loop.star", "x = [i for i in range(1000000000)]\ndef transform(r, m):\n    return r\n"),
+		Function: "transform",
+		Timeout:  60000,
+	})
+	if err == nil || !strings.Contains(err.Error(), "too many steps") {
+		t.Errorf("got %v loading looping script, want too many steps", err)
+	}
+
+	s, err := NewScript(ctx, ScriptConfig{
+		File:     writeTestFile(t, "slow.star", "def transform(r, m):\n    return [r for i in range(1000000000)]\n"),
+		Function: "transform",
+		Timeout:  60000,
+	})
+	if err != nil {
+		t.Fatalf("error loading script: %v", err)
+	}
+	if _, err := s.Run(&Message{}, simpleRecord{}); err == nil || !strings.Contains(err.Error(), "too many steps") {
+		t.Errorf("got %v running looping script, want too many steps", err)
+	}
+}
+
+func TestTestScript(t *testing.T) {
+	p := testPipeline(t)
+	other := *p
+	other.Name = "other"
+	cfg.Pipelines = append(cfg.Pipelines, &other)
+	cfg.Script = ScriptConfig{
+		File:     writeTestFile(t, "split.star", testScriptSource),
+		Function: "transform",
+		Timeout:  1000,
+	}
+	samples := writeTestFile(t, "samples.jsonl", strings.Join([]string{
+		`{"id":"a"}`,
+		`{"attributes":{"source":"web"},"data":{"id":"b","count":2}}`,
+		`{"attributes":{"source":"app"},"data":"{\"id\":\"c\"}"}`,
+		`{"id":"d","skip":true}`,
+		`not json`,
+	}, "\n"))
+
+	var out bytes.Buffer
+	failed, err := testScript(context.Background(), samples, "other", &out)
+	if err != nil {
+		t.Fatalf("error testing script: %v", err)
+	}
+	if failed != 1 {
+		t.Errorf("got %d failed samples, want 1", failed)
+	}
+	for _, want := range []string{
+		`line 1: record 0: {"id":"a","n":0,"source":"unknown"}`,
+		`line 2: record 1: {"id":"b","n":1,"source":"web"}`,
+		`line 3: record 0: {"id":"c","n":0,"source":"app"}`,
+		`line 4: skipped`,
+		`line 5: error:`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+
+	if _, err := testScript(context.Background(), samples, "missing", &out); err == nil {
+		t.Errorf("expected error for unknown pipeline")
+	}
+}
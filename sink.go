@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	// sink types
+	sinkTypeBigQuery = "bigquery"
+	sinkTypeStorage  = "storage"
+	sinkTypeLoad     = "load"
+	sinkTypeMemory   = "memory"
+)
+
+// Sink writes records to their destination.
+// Records are buffered on Append and written on Flush which returns result for each record
+type Sink interface {
+	Append(ctx context.Context, rec *Record) error
+	Flush(ctx context.Context) ([]*RecordResult, error)
+	Close() error
+}
+
+// drainSink is implemented by sinks which should only be flushed once
+// at the end of the drain rather than each time batch size is reached
+type drainSink interface {
+	FlushOnDrain() bool
+}
+
+// flushOnDrain checks whether sink should only be flushed at the end of the drain
+func flushOnDrain(s Sink) bool {
+	ds, ok := s.(drainSink)
+	return ok && ds.FlushOnDrain()
+}
+
+// NewSink creates sink of the provided type writing into ds.table.
+// Batch size is the number of rows staged in single file by load sink
+func NewSink(ctx context.Context, sinkType, ds, table string, batchSize int) (s Sink, err error) {
+	switch sinkType {
+	case "", sinkTypeBigQuery:
+		return NewBigQuerySink(ctx, ds, table)
+	case sinkTypeStorage:
+		return NewStorageSink(ctx, ds, table, cfg.Sink.StorageStream)
+	case sinkTypeLoad:
+		return NewLoadSink(ctx, ds, table, cfg.Sink.LoadStaging, batchSize)
+	case sinkTypeMemory:
+		return newMemorySink(memoryReject), nil
+	default:
+		return nil, fmt.Errorf("invalid sink type: %s", sinkType)
+	}
+}
+
+// Record is a single row along with the message it came from.
+// Table is the destination table when routed, empty for the default one
+type Record struct {
+	ID     string
+	Table  string
+	Values simpleRecord
+	Msg    *Message
+}
+
+// withdrawCanceled returns records whose messages were not canceled while they waited
+// for the flush, records are filtered in place
+func withdrawCanceled(recs []*Record) []*Record {
+	active := recs[:0]
+	for _, rec := range recs {
+		if rec.Msg != nil && rec.Msg.Canceled() {
+			continue
+		}
+		active = append(active, rec)
+	}
+	return active
+}
+
+// Save implements bigquery.ValueSaver using record ID as insert ID
+func (r *Record) Save() (map[string]bigquery.Value, string, error) {
+	return toJSONValues(r.Values), r.ID, nil
+}
+
+// RecordResult is the outcome of writing single record, Err is nil when accepted.
+// Retry is set when the record failed for reasons other than the record itself
+type RecordResult struct {
+	Record *Record
+	Err    error
+	Retry  bool
+}
+
+// retryError marks append failures which are not the message's fault,
+// such message is redelivered rather than sent to dead-letter
+type retryError struct {
+	err error
+}
+
+func (e *retryError) Error() string {
+	return e.err.Error()
+}
+
+var (
+	// decides whether records written to memory sinks fail and whether to retry them,
+	// set by tests to have the pump handle records the table rejects
+	memoryReject func(rec *Record) (retry bool, err error)
+)
+
+// memorySink keeps written records in memory, used in local runs and tests.
+// Optional reject func decides whether record should fail and be retried
+type memorySink struct {
+	mu      sync.Mutex
+	reject  func(rec *Record) (bool, error)
+	pending []*Record
+	written []*Record
+}
+
+func newMemorySink(reject func(rec *Record) (bool, error)) *memorySink {
+	return &memorySink{
+		reject:  reject,
+		pending: make([]*Record, 0),
+		written: make([]*Record, 0),
+	}
+}
+
+func (s *memorySink) Append(ctx context.Context, rec *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, rec)
+	return nil
+}
+
+func (s *memorySink) Flush(ctx context.Context) ([]*RecordResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = withdrawCanceled(s.pending)
+	results := make([]*RecordResult, 0, len(s.pending))
+	for _, rec := range s.pending {
+		var err error
+		retry := false
+		if s.reject != nil {
+			retry, err = s.reject(rec)
+		}
+		if err == nil {
+			s.written = append(s.written, rec)
+		}
+		results = append(results, &RecordResult{Record: rec, Err: err, Retry: retry})
+	}
+	s.pending = make([]*Record, 0)
+	return results, nil
+}
+
+// Written returns all records accepted by the sink so far
+func (s *memorySink) Written() []*Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Record(nil), s.written...)
+}
+
+func (s *memorySink) Close() error {
+	logger.Printf("memory sink wrote %d records", len(s.Written()))
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	// source types
+	sourceTypePubSub = "pubsub"
+	sourceTypeFile   = "file"
+
+	// max size of single line in file source
+	maxFileLineSize = 10 * 1024 * 1024
+
+	// longest time between checks whether source stalled
+	maxStallCheck = 5 * time.Second
+)
+
+// Message is a single message received from the source.
+// It has to be either acked or nacked once processed
+type Message struct {
+	ID              string
+	Data            []byte
+	Attributes      map[string]string
+	PublishTime     time.Time
+	OrderingKey     string
+	DeliveryAttempt *int
+
+	once sync.Once
+	ack  func()
+	nack func()
+
+	// set once whoever waits for the insert gave up on it
+	canceled int32
+}
+
+// Cancel withdraws message from the batch it's buffered in, its records are not written
+// unless they already are and it's left for the source to redeliver
+func (m *Message) Cancel() {
+	atomic.StoreInt32(&m.canceled, 1)
+}
+
+// Canceled checks whether message was withdrawn from its batch
+func (m *Message) Canceled() bool {
+	return atomic.LoadInt32(&m.canceled) == 1
+}
+
+// Ack acknowledges the message, only first ack or nack has any effect
+func (m *Message) Ack() {
+	m.once.Do(func() {
+		if m.ack != nil {
+			m.ack()
+		}
+	})
+}
+
+// Nack lets the source redeliver the message, only first ack or nack has any effect
+func (m *Message) Nack() {
+	m.once.Do(func() {
+		if m.nack != nil {
+			m.nack()
+		}
+	})
+}
+
+// Source delivers messages to the pump.
+// Receive calls f for each message until ctx is canceled or the source is drained,
+// Stalled is closed once the source received no message for max stall
+type Source interface {
+	Receive(ctx context.Context, f func(ctx context.Context, msg *Message)) error
+	Stalled(ctx context.Context, maxStall time.Duration) <-chan struct{}
+	Close() error
+}
+
+// stallDetector tracks when the source received its last message,
+// sources embed it and touch it on each message they deliver
+type stallDetector struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (d *stallDetector) touch() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.last = time.Now()
+}
+
+func (d *stallDetector) idle() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return time.Since(d.last)
+}
+
+// Stalled returns channel closed once there was no message for max stall, counting from now.
+// It's checked every tenth of max stall, at most maxStallCheck apart, until ctx is canceled
+func (d *stallDetector) Stalled(ctx context.Context, maxStall time.Duration) <-chan struct{} {
+	d.touch()
+	every := maxStall / 10
+	if every > maxStallCheck {
+		every = maxStallCheck
+	}
+	if every <= 0 {
+		every = time.Millisecond
+	}
+	stalled := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if d.idle() > maxStall {
+				close(stalled)
+				return
+			}
+		}
+	}()
+	return stalled
+}
+
+// intervalSource is implemented by sources whose deliveries wait for their insert
+// so buffered records are inserted on interval too rather than only once batch size is reached
+type intervalSource interface {
+	FlushInterval() time.Duration
+}
+
+// flushInterval returns how often records of the source are inserted, zero for only on batch size
+func flushInterval(s Source) time.Duration {
+	is, ok := s.(intervalSource)
+	if !ok {
+		return 0
+	}
+	return is.FlushInterval()
+}
+
+// NewSource creates source of the provided type.
+// Target is subscription name for pubsub and file path for file.
+// Max outstanding is the number of messages which may be held un-acked, negative for no limit
+func NewSource(ctx context.Context, srcType, target string, maxOutstanding int) (s Source, err error) {
+	switch srcType {
+	case "", sourceTypePubSub:
+		return newPubSubSource(ctx, target, maxOutstanding)
+	case sourceTypeFile:
+		return newFileSource(target)
+	default:
+		return nil, fmt.Errorf("invalid source type: %s", srcType)
+	}
+}
+
+// pubSubSource receives messages from pubsub subscription
+type pubSubSource struct {
+	stallDetector
+	client *pubsub.Client
+	sub    *pubsub.Subscription
+}
+
+func newPubSubSource(ctx context.Context, sub string, maxOutstanding int) (*pubSubSource, error) {
+	if sub == "" {
+		return nil, fmt.Errorf("subscription name required")
+	}
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub client[%s]: %v", projectID, err)
+	}
+	s := client.Subscription(sub)
+	s.ReceiveSettings.MaxOutstandingMessages = maxOutstandingMessages(maxOutstanding)
+	return &pubSubSource{client: client, sub: s}, nil
+}
+
+// maxOutstandingMessages returns receive limit of un-acked messages, messages are held
+// un-acked until their batch is inserted so it's raised above the client default to fit
+// the whole batch, but never lowered. Negative is unlimited, zero is the client default
+func maxOutstandingMessages(maxOutstanding int) int {
+	if maxOutstanding < 0 || maxOutstanding > pubsub.DefaultReceiveSettings.MaxOutstandingMessages {
+		return maxOutstanding
+	}
+	return 0
+}
+
+// Receive does not return until all delivered messages are acked or nacked
+func (s *pubSubSource) Receive(ctx context.Context, f func(ctx context.Context, msg *Message)) error {
+	return s.sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		s.touch()
+		f(ctx, &Message{
+			ID:              m.ID,
+			Data:            m.Data,
+			Attributes:      m.Attributes,
+			PublishTime:     m.PublishTime,
+			OrderingKey:     m.OrderingKey,
+			DeliveryAttempt: m.DeliveryAttempt,
+			ack:             m.Ack,
+			nack:            m.Nack,
+		})
+	})
+}
+
+func (s *pubSubSource) Close() error {
+	return s.client.Close()
+}
+
+// memorySource delivers provided messages in order, used in local runs and tests.
+// Acked and nacked message IDs are recorded
+type memorySource struct {
+	stallDetector
+	mu       sync.Mutex
+	messages []*Message
+	acked    []string
+	nacked   []string
+}
+
+func newMemorySource(messages []*Message) *memorySource {
+	return &memorySource{
+		messages: messages,
+		acked:    make([]string, 0),
+		nacked:   make([]string, 0),
+	}
+}
+
+func (s *memorySource) Receive(ctx context.Context, f func(ctx context.Context, msg *Message)) error {
+	for _, m := range s.messages {
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.touch()
+		id := m.ID
+		m.ack = func() { s.record(&s.acked, id) }
+		m.nack = func() { s.record(&s.nacked, id) }
+		f(ctx, m)
+	}
+	return nil
+}
+
+func (s *memorySource) record(list *[]string, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*list = append(*list, id)
+}
+
+func (s *memorySource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	logger.Printf("memory source acked %d messages, nacked %d", len(s.acked), len(s.nacked))
+	return nil
+}
+
+// newFileSource creates memory source from newline-delimited file
+// where each non-empty line is the data of a single message
+func newFileSource(path string) (*memorySource, error) {
+	if path == "" {
+		return nil, fmt.Errorf("source file path required")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("source file[%s]: %v", path, err)
+	}
+	defer f.Close()
+
+	name := filepath.Base(path)
+	messages := make([]*Message, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFileLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		messages = append(messages, &Message{
+			ID:          fmt.Sprintf("%s-%d", name, line),
+			Data:        append([]byte(nil), scanner.Bytes()...),
+			Attributes:  map[string]string{},
+			PublishTime: time.Now().UTC(),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("source file[%s] read: %v", path, err)
+	}
+	return newMemorySource(messages), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+func TestFileSourceReplay(t *testing.T) {
+	p := testPipeline(t)
+	p.BatchSize = 2
+	memoryReject = func(rec *Record) (bool, error) {
+		if rec.Values["status"] == "bad" {
+			return false, fmt.Errorf("invalid status")
+		}
+		return false, nil
+	}
+
+	src, err := newFileSource("testdata/replay.json")
+	if err != nil {
+		t.Fatalf("error creating file source: %v", err)
+	}
+	// message IDs are the line numbers, empty lines are skipped
+	ids := make([]string, 0)
+	for _, m := range src.messages {
+		ids = append(ids, m.ID)
+	}
+	want := "replay.json-1,replay.json-2,replay.json-4,replay.json-5,replay.json-6"
+	if got := strings.Join(ids, ","); got != want {
+		t.Fatalf("got messages %s, want %s", got, want)
+	}
+
+	r, err := pump(p, src)
+	if err != nil {
+		t.Fatalf("error on pump: %v", err)
+	}
+	if r.Messages != 5 || r.Accepted != 3 || r.Rejected != 2 {
+		t.Errorf("got %d messages, %d accepted, %d rejected, want 5, 3, 2",
+			r.Messages, r.Accepted, r.Rejected)
+	}
+	if len(src.acked) != 5 || len(src.nacked) != 0 {
+		t.Errorf("acked %v, nacked %v, want all acked", src.acked, src.nacked)
+	}
+	dl := deadLettered(t)
+	if _, ok := dl["replay.json-4"]; !ok || len(dl) != 2 {
+		t.Errorf("dead-lettered %v, want lines 4 and 5", dl)
+	}
+}
+
+func TestStallDetector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var d stallDetector
+	maxStall := 100 * time.Millisecond
+	stalled := d.Stalled(ctx, maxStall)
+
+	// messages keep the source from stalling
+	for i := 0; i < 5; i++ {
+		time.Sleep(maxStall / 2)
+		d.touch()
+	}
+	select {
+	case <-stalled:
+		t.Fatalf("stalled while receiving messages")
+	default:
+	}
+
+	select {
+	case <-stalled:
+	case <-time.After(time.Second):
+		t.Fatalf("not stalled after %v without messages", maxStall)
+	}
+}
+
+func TestPumpStopsOnStall(t *testing.T) {
+	p := testPipeline(t)
+	p.MaxStall = 1
+
+	// push source without deliveries only stops once it stalls
+	start := time.Now()
+	r, err := pump(p, newPushSource(time.Second))
+	if err != nil {
+		t.Fatalf("error on pump: %v", err)
+	}
+	if r.Messages != 0 {
+		t.Errorf("got %d messages, want none", r.Messages)
+	}
+	if took := time.Since(start); took < time.Second || took > 3*time.Second {
+		t.Errorf("pump stopped after %v, want after max stall", took)
+	}
+}
+
+func TestMaxOutstandingMessages(t *testing.T) {
+	def := pubsub.DefaultReceiveSettings.MaxOutstandingMessages
+	for _, tt := range []struct{ in, want int }{
+		{10, 0},
+		{def, 0},
+		{def + 1, def + 1},
+		{-1, -1},
+	} {
+		if got := maxOutstandingMessages(tt.in); got != tt.want {
+			t.Errorf("maxOutstandingMessages(%d) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
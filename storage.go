@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"cloud.google.com/go/civil"
+	storagepb "google.golang.org/genproto/googleapis/cloud/bigquery/storage/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// storage write API stream types
+	storageStreamCommitted = "committed"
+	storageStreamPending   = "pending"
+
+	// attempts to append rows at the same offset before the committed stream is dropped
+	storageAppendAttempts = 3
+
+	// min time between table schema refreshes triggered by unknown fields
+	storageSchemaRefresh = 10 * time.Second
+)
+
+// storageSink writes records into BigQuery table using the Storage Write API.
+// Committed mode appends all flushes of single run to one stream at explicit offsets,
+// pending mode writes each flush to its own stream and commits it atomically.
+// Row descriptor is rebuilt when records have fields the table schema didn't have
+type storageSink struct {
+	mu            sync.Mutex
+	client        *managedwriter.Client
+	bqClient      *bigquery.Client
+	ref           *bigquery.Table
+	table         string
+	streamType    string
+	schema        bigquery.Schema
+	descriptor    protoreflect.MessageDescriptor
+	descProto     *descriptorpb.DescriptorProto
+	schemaChanged bool
+	refreshedAt   time.Time
+	stream        *managedwriter.ManagedStream
+	offset        int64
+	pending       []*Record
+}
+
+// NewStorageSink creates Storage Write API sink for ds.table
+// using the table schema to build the protobuf row descriptor
+func NewStorageSink(ctx context.Context, ds, table, streamType string) (s Sink, err error) {
+	switch streamType {
+	case "", storageStreamCommitted:
+		streamType = storageStreamCommitted
+	case storageStreamPending:
+	default:
+		return nil, fmt.Errorf("invalid storage stream type: %s", streamType)
+	}
+
+	bqClient, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("bigquery client[%s]: %v", projectID, err)
+	}
+
+	ref := bqClient.Dataset(ds).Table(table)
+	meta, err := ref.Metadata(ctx)
+	if err != nil {
+		bqClient.Close()
+		return nil, fmt.Errorf("table metadata[%s.%s]: %v", ds, table, err)
+	}
+
+	md, dp, err := schemaToDescriptor(meta.Schema)
+	if err != nil {
+		bqClient.Close()
+		return nil, fmt.Errorf("table schema[%s.%s]: %v", ds, table, err)
+	}
+
+	client, err := managedwriter.NewClient(ctx, projectID)
+	if err != nil {
+		bqClient.Close()
+		return nil, fmt.Errorf("storage client[%s]: %v", projectID, err)
+	}
+
+	return &storageSink{
+		client:      client,
+		bqClient:    bqClient,
+		ref:         ref,
+		table:       managedwriter.TableParentFromParts(projectID, ds, table),
+		streamType:  streamType,
+		schema:      meta.Schema,
+		descriptor:  md,
+		descProto:   dp,
+		refreshedAt: time.Now(),
+		pending:     make([]*Record, 0),
+	}, nil
+}
+
+// schemaToDescriptor converts BigQuery schema into protobuf message descriptor
+func schemaToDescriptor(schema bigquery.Schema) (protoreflect.MessageDescriptor, *descriptorpb.DescriptorProto, error) {
+	ts, err := adapt.BQSchemaToStorageTableSchema(schema)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := adapt.StorageSchemaToProto2Descriptor(ts, "root")
+	if err != nil {
+		return nil, nil, err
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid message descriptor: %T", d)
+	}
+	dp, err := adapt.NormalizeDescriptor(md)
+	if err != nil {
+		return nil, nil, err
+	}
+	return md, dp, nil
+}
+
+func (s *storageSink) Append(ctx context.Context, rec *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, rec)
+	return nil
+}
+
+// toRow encodes record values as protobuf row, fields not in the table schema fail the record
+func (s *storageSink) toRow(rec *Record) ([]byte, error) {
+	if unknown := unknownFields(s.schema, rec.Values, ""); len(unknown) > 0 {
+		return nil, fmt.Errorf("no such field: %s", strings.Join(unknown, ", "))
+	}
+	b, err := json.Marshal(toStorageValues(s.schema, rec.Values))
+	if err != nil {
+		return nil, err
+	}
+	msg := dynamicpb.NewMessage(s.descriptor)
+	if err := protojson.Unmarshal(b, msg); err != nil {
+		return nil, fmt.Errorf("invalid row for table schema: %v", err)
+	}
+	return proto.Marshal(msg)
+}
+
+// refreshSchema rebuilds the row descriptor from the current table schema so columns added
+// since the sink was created are written, open committed stream gets it with the next append
+func (s *storageSink) refreshSchema(ctx context.Context) error {
+	if time.Since(s.refreshedAt) < storageSchemaRefresh {
+		return nil
+	}
+	s.refreshedAt = time.Now()
+	meta, err := s.ref.Metadata(ctx)
+	if err != nil {
+		return fmt.Errorf("table metadata[%s]: %v", s.table, err)
+	}
+	md, dp, err := schemaToDescriptor(meta.Schema)
+	if err != nil {
+		return fmt.Errorf("table schema[%s]: %v", s.table, err)
+	}
+	logger.Printf("refreshed table schema[%s], %d columns", s.table, len(meta.Schema))
+	s.schema, s.descriptor, s.descProto = meta.Schema, md, dp
+	s.schemaChanged = true
+	return nil
+}
+
+// unknownFields returns dotted paths of the record fields which are not in schema
+func unknownFields(schema bigquery.Schema, rec simpleRecord, prefix string) []string {
+	fields := make(map[string]*bigquery.FieldSchema, len(schema))
+	for _, f := range schema {
+		fields[strings.ToLower(f.Name)] = f
+	}
+	unknown := make([]string, 0)
+	for k, v := range rec {
+		f, ok := fields[strings.ToLower(k)]
+		if !ok {
+			unknown = append(unknown, prefix+k)
+			continue
+		}
+		if normalizeFieldType(f.Type) != bigquery.RecordFieldType {
+			continue
+		}
+		items, ok := v.([]bigquery.Value)
+		if !ok {
+			items = []bigquery.Value{v}
+		}
+		for _, item := range items {
+			switch m := item.(type) {
+			case simpleRecord:
+				unknown = append(unknown, unknownFields(f.Schema, m, prefix+k+".")...)
+			case map[string]interface{}:
+				nested := make(simpleRecord, len(m))
+				for nk, nv := range m {
+					nested[nk] = nv
+				}
+				unknown = append(unknown, unknownFields(f.Schema, nested, prefix+k+".")...)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+func (s *storageSink) newStream(ctx context.Context, t managedwriter.StreamType) (*managedwriter.ManagedStream, error) {
+	return s.client.NewManagedStream(ctx,
+		managedwriter.WithDestinationTable(s.table),
+		managedwriter.WithType(t),
+		managedwriter.WithSchemaDescriptor(s.descProto),
+	)
+}
+
+// Flush encodes pending records, records which can't be encoded are rejected. Records with
+// fields not in the table schema refresh it first, when still unknown they are retried while
+// schema evolution may be adding the columns. Encoded rows are appended all-or-nothing
+// so any append error fails the whole flush
+func (s *storageSink) Flush(ctx context.Context) ([]*RecordResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() {
+		s.pending = make([]*Record, 0)
+	}()
+	s.pending = withdrawCanceled(s.pending)
+
+	for _, rec := range s.pending {
+		if len(unknownFields(s.schema, rec.Values, "")) > 0 {
+			if err := s.refreshSchema(ctx); err != nil {
+				logger.Printf("error refreshing schema: %v", err)
+			}
+			break
+		}
+	}
+
+	results := make([]*RecordResult, 0, len(s.pending))
+	rows := make([][]byte, 0, len(s.pending))
+	for _, rec := range s.pending {
+		row, err := s.toRow(rec)
+		if err == nil {
+			rows = append(rows, row)
+		}
+		retry := err != nil && cfg.Schema.Evolve == evolveModeOn && len(unknownFields(s.schema, rec.Values, "")) > 0
+		results = append(results, &RecordResult{Record: rec, Err: err, Retry: retry})
+	}
+	if len(rows) == 0 {
+		return results, nil
+	}
+
+	var err error
+	if s.streamType == storageStreamPending {
+		err = s.appendPending(ctx, rows)
+	} else {
+		err = s.appendCommitted(ctx, rows)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// appendCommitted appends rows to the run's committed stream at the next offset. Failed
+// append is retried at the same offset so rows which did land are not written twice,
+// rows already present at that offset mean the earlier attempt succeeded. Once attempts
+// are exhausted the stream is dropped so its offsets are never reused for different rows
+func (s *storageSink) appendCommitted(ctx context.Context, rows [][]byte) (err error) {
+	if s.stream == nil {
+		ms, err := s.newStream(ctx, managedwriter.CommittedStream)
+		if err != nil {
+			return fmt.Errorf("storage stream[%s]: %v", s.table, err)
+		}
+		s.stream = ms
+		s.offset = 0
+		s.schemaChanged = false
+	}
+	defer func() {
+		if err != nil {
+			s.closeStream()
+		}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		appendErr := s.appendAt(ctx, rows)
+		if appendErr == nil || status.Code(appendErr) == codes.AlreadyExists {
+			s.offset += int64(len(rows))
+			s.schemaChanged = false
+			return nil
+		}
+		if attempt == storageAppendAttempts || ctx.Err() != nil {
+			return fmt.Errorf("storage append[%s]: %v", s.stream.StreamName(), appendErr)
+		}
+		logger.Printf("error appending at offset %d, retrying: %v", s.offset, appendErr)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// appendAt appends rows to the committed stream at its current offset
+// along with the new row descriptor when the table schema changed
+func (s *storageSink) appendAt(ctx context.Context, rows [][]byte) error {
+	opts := []managedwriter.AppendOption{managedwriter.WithOffset(s.offset)}
+	if s.schemaChanged {
+		opts = append(opts, managedwriter.UpdateSchemaDescriptor(s.descProto))
+	}
+	res, err := s.stream.AppendRows(ctx, rows, opts...)
+	if err != nil {
+		return err
+	}
+	_, err = res.GetResult(ctx)
+	return err
+}
+
+// appendPending writes rows to a new pending stream, finalizes and commits it
+func (s *storageSink) appendPending(ctx context.Context, rows [][]byte) error {
+	ms, err := s.newStream(ctx, managedwriter.PendingStream)
+	if err != nil {
+		return fmt.Errorf("storage stream[%s]: %v", s.table, err)
+	}
+	defer ms.Close()
+
+	res, err := ms.AppendRows(ctx, rows, managedwriter.WithOffset(0))
+	if err != nil {
+		return fmt.Errorf("storage append[%s]: %v", ms.StreamName(), err)
+	}
+	if _, err := res.GetResult(ctx); err != nil {
+		return fmt.Errorf("storage append result[%s]: %v", ms.StreamName(), err)
+	}
+	if _, err := ms.Finalize(ctx); err != nil {
+		return fmt.Errorf("storage finalize[%s]: %v", ms.StreamName(), err)
+	}
+
+	resp, err := s.client.BatchCommitWriteStreams(ctx, &storagepb.BatchCommitWriteStreamsRequest{
+		Parent:       s.table,
+		WriteStreams: []string{ms.StreamName()},
+	})
+	if err != nil {
+		return fmt.Errorf("storage commit[%s]: %v", ms.StreamName(), err)
+	}
+	if errs := resp.GetStreamErrors(); len(errs) > 0 {
+		return fmt.Errorf("storage commit[%s]: %v", ms.StreamName(), errs[0].GetErrorMessage())
+	}
+	return nil
+}
+
+// closeStream finalizes and closes the committed stream if one is open
+func (s *storageSink) closeStream() {
+	if s.stream == nil {
+		return
+	}
+	if _, err := s.stream.Finalize(context.Background()); err != nil {
+		logger.Printf("error finalizing stream[%s]: %v", s.stream.StreamName(), err)
+	}
+	s.stream.Close()
+	s.stream = nil
+}
+
+func (s *storageSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeStream()
+	s.bqClient.Close()
+	return s.client.Close()
+}
+
+// toStorageValues encodes coerced record values using the Storage Write API
+// representation of their column types so they can be unmarshalled into protobuf row
+func toStorageValues(schema bigquery.Schema, rec simpleRecord) simpleRecord {
+	fields := make(map[string]*bigquery.FieldSchema, len(schema))
+	for _, f := range schema {
+		fields[strings.ToLower(f.Name)] = f
+	}
+	out := make(simpleRecord, len(rec))
+	for k, v := range rec {
+		f, ok := fields[strings.ToLower(k)]
+		if !ok {
+			out[k] = v
+			continue
+		}
+		// descriptor field names are lowercased column names
+		name := strings.ToLower(f.Name)
+		if list, ok := v.([]bigquery.Value); ok {
+			items := make([]bigquery.Value, len(list))
+			for i, item := range list {
+				items[i] = toStorageValue(f, item)
+			}
+			out[name] = items
+			continue
+		}
+		out[name] = toStorageValue(f, v)
+	}
+	return out
+}
+
+func toStorageValue(f *bigquery.FieldSchema, v bigquery.Value) bigquery.Value {
+	switch t := v.(type) {
+	case time.Time:
+		return t.UnixMicro()
+	case civil.Date:
+		return t.DaysSince(civil.Date{Year: 1970, Month: time.January, Day: 1})
+	case civil.DateTime:
+		return encodeDateTime(t)
+	case civil.Time:
+		return encodeTime(t)
+	case *big.Rat:
+		scale := bigquery.NumericScaleDigits
+		if normalizeFieldType(f.Type) == bigquery.BigNumericFieldType {
+			scale = bigquery.BigNumericScaleDigits
+		}
+		return encodeNumeric(t, scale)
+	case simpleRecord:
+		return toStorageValues(f.Schema, t)
+	case map[string]interface{}:
+		nested := make(simpleRecord, len(t))
+		for k, v := range t {
+			nested[k] = v
+		}
+		return toStorageValues(f.Schema, nested)
+	default:
+		return v
+	}
+}
+
+// encodeTime packs time as hour, minute, second and microseconds bit fields
+func encodeTime(t civil.Time) int64 {
+	sec := int64(t.Hour)<<12 | int64(t.Minute)<<6 | int64(t.Second)
+	return sec<<20 | int64(t.Nanosecond/1000)
+}
+
+// encodeDateTime packs datetime as year, month, day, hour, minute, second and microseconds bit fields
+func encodeDateTime(dt civil.DateTime) int64 {
+	sec := int64(dt.Date.Year)<<26 | int64(dt.Date.Month)<<22 | int64(dt.Date.Day)<<17 |
+		int64(dt.Time.Hour)<<12 | int64(dt.Time.Minute)<<6 | int64(dt.Time.Second)
+	return sec<<20 | int64(dt.Time.Nanosecond/1000)
+}
+
+// encodeNumeric encodes numeric as little-endian two's complement of its value scaled to integer
+func encodeNumeric(r *big.Rat, scale int) []byte {
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)))
+	i := new(big.Int).Quo(scaled.Num(), scaled.Denom())
+
+	// two's complement of negative values
+	size := len(i.Bytes()) + 1
+	if i.Sign() < 0 {
+		mod := new(big.Int).Lsh(big.NewInt(1), uint(size*8))
+		i.Add(i, mod)
+	}
+	b := i.FillBytes(make([]byte, size))
+	for l, r := 0, len(b)-1; l < r; l, r = l+1, r-1 {
+		b[l], b[r] = b[r], b[l]
+	}
+	return b
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestUnknownFields(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.StringFieldType},
+		{Name: "user", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "name", Type: bigquery.StringFieldType},
+		}},
+		{Name: "tags", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+			{Name: "key", Type: bigquery.StringFieldType},
+		}},
+	}
+	rec := simpleRecord{
+		"ID":   "1",
+		"new":  true,
+		"user": map[string]interface{}{"name": "a", "age": 2},
+		"tags": []bigquery.Value{simpleRecord{"key": "k", "value": "v"}},
+	}
+	if got := strings.Join(unknownFields(schema, rec, ""), ","); got != "new,tags.value,user.age" {
+		t.Errorf("got unknown fields %s, want new,tags.value,user.age", got)
+	}
+	if got := unknownFields(schema, simpleRecord{"id": "1"}, ""); len(got) > 0 {
+		t.Errorf("got unknown fields %v, want none", got)
+	}
+}
+
+func TestToRowMixedCase(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "userId", Type: bigquery.StringFieldType},
+		{Name: "Profile", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "firstName", Type: bigquery.StringFieldType},
+			{Name: "Tags", Type: bigquery.StringFieldType, Repeated: true},
+		}},
+	}
+	md, _, err := schemaToDescriptor(schema)
+	if err != nil {
+		t.Fatalf("error creating descriptor: %v", err)
+	}
+	s := &storageSink{schema: schema, descriptor: md}
+
+	values, err := NewSchemaConverter(schema).Convert(simpleRecord{
+		"userId":  "u1",
+		"Profile": map[string]interface{}{"firstName": "a", "Tags": []interface{}{"x", "y"}},
+	})
+	if err != nil {
+		t.Fatalf("error converting record: %v", err)
+	}
+	b, err := s.toRow(&Record{Values: values})
+	if err != nil {
+		t.Fatalf("error encoding row: %v", err)
+	}
+
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(b, msg); err != nil {
+		t.Fatalf("error decoding row: %v", err)
+	}
+	fields := md.Fields()
+	if got := msg.Get(fields.ByName("userid")).String(); got != "u1" {
+		t.Errorf("got userid %q, want u1", got)
+	}
+	profile := msg.Get(fields.ByName("profile")).Message()
+	nested := profile.Descriptor().Fields()
+	if got := profile.Get(nested.ByName("firstname")).String(); got != "a" {
+		t.Errorf("got profile.firstname %q, want a", got)
+	}
+	if got := profile.Get(nested.ByName("tags")).List().Len(); got != 2 {
+		t.Errorf("got %d profile.tags, want 2", got)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// TableSpec describes the table created when it doesn't exist.
+// Without schema file the schema is inferred from the first sample size records
+type TableSpec struct {
+	SchemaFile     string   `yaml:"schema_file" env:"TABLE_SCHEMA_FILE"`
+	SampleSize     int      `yaml:"sample_size" env:"SCHEMA_SAMPLE_SIZE"`
+	PartitionType  string   `yaml:"partition_type" env:"TABLE_PARTITION_TYPE"`
+	PartitionField string   `yaml:"partition_field" env:"TABLE_PARTITION_FIELD"`
+	ClusterFields  []string `yaml:"cluster_fields" env:"TABLE_CLUSTER_FIELDS"`
+	Location       string   `yaml:"location" env:"DATASET_LOCATION"`
+}
+
+// TableCreator creates the dataset and table when they don't exist
+type TableCreator struct {
+	client *bigquery.Client
+	ds     *bigquery.Dataset
+	table  *bigquery.Table
+	spec   TableSpec
+	schema bigquery.Schema
+}
+
+// NewTableCreator creates table creator for ds.table loading the schema file when set
+func NewTableCreator(ctx context.Context, ds, table string, spec TableSpec) (*TableCreator, error) {
+	spec.PartitionType = strings.ToUpper(spec.PartitionType)
+	if spec.PartitionType == "" && spec.PartitionField != "" {
+		spec.PartitionType = string(bigquery.DayPartitioningType)
+	}
+	switch bigquery.TimePartitioningType(spec.PartitionType) {
+	case "", bigquery.DayPartitioningType, bigquery.HourPartitioningType,
+		bigquery.MonthPartitioningType, bigquery.YearPartitioningType:
+	default:
+		return nil, fmt.Errorf("invalid partition type: %s", spec.PartitionType)
+	}
+	if spec.SampleSize < 1 {
+		spec.SampleSize = 1
+	}
+
+	var schema bigquery.Schema
+	if spec.SchemaFile != "" {
+		b, err := readFile(ctx, spec.SchemaFile)
+		if err != nil {
+			return nil, fmt.Errorf("schema file[%s]: %v", spec.SchemaFile, err)
+		}
+		if schema, err = bigquery.SchemaFromJSON(b); err != nil {
+			return nil, fmt.Errorf("schema file[%s] parse: %v", spec.SchemaFile, err)
+		}
+	}
+
+	client, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("bigquery client[%s]: %v", projectID, err)
+	}
+	return &TableCreator{
+		client: client,
+		ds:     client.Dataset(ds),
+		table:  client.Dataset(ds).Table(table),
+		spec:   spec,
+		schema: schema,
+	}, nil
+}
+
+// Schema returns the schema from schema file, nil when it has to be inferred
+func (c *TableCreator) Schema() bigquery.Schema {
+	return c.schema
+}
+
+// SampleSize returns the number of records the schema is inferred from
+func (c *TableCreator) SampleSize() int {
+	return c.spec.SampleSize
+}
+
+// Exists checks whether the table exists
+func (c *TableCreator) Exists(ctx context.Context) (bool, error) {
+	if _, err := c.table.Metadata(ctx); err != nil {
+		if isAPIError(err, http.StatusNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("table metadata: %v", err)
+	}
+	return true, nil
+}
+
+// Create creates the dataset when missing and the table with provided schema.
+// Returns the schema of the table which may differ if it was created concurrently
+func (c *TableCreator) Create(ctx context.Context, schema bigquery.Schema) (bigquery.Schema, error) {
+	if len(schema) == 0 {
+		return nil, fmt.Errorf("empty table schema")
+	}
+
+	err := c.ds.Create(ctx, &bigquery.DatasetMetadata{Location: c.spec.Location})
+	if err != nil && !isAPIError(err, http.StatusConflict) {
+		return nil, fmt.Errorf("dataset create: %v", err)
+	}
+
+	if err := c.table.Create(ctx, c.metadata(schema)); err != nil {
+		if !isAPIError(err, http.StatusConflict) {
+			return nil, fmt.Errorf("table create: %v", err)
+		}
+		logger.Printf("table %s.%s already exists", c.ds.DatasetID, c.table.TableID)
+		existing, err := c.table.Metadata(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("table metadata: %v", err)
+		}
+		return existing.Schema, nil
+	}
+	logger.Printf("created table %s.%s with %d columns", c.ds.DatasetID, c.table.TableID, len(schema))
+	return schema, nil
+}
+
+// metadata returns the metadata of the table created with schema
+func (c *TableCreator) metadata(schema bigquery.Schema) *bigquery.TableMetadata {
+	meta := &bigquery.TableMetadata{Schema: schema}
+	if c.spec.PartitionType != "" {
+		meta.TimePartitioning = &bigquery.TimePartitioning{
+			Type:  bigquery.TimePartitioningType(c.spec.PartitionType),
+			Field: c.spec.PartitionField,
+		}
+	}
+	if len(c.spec.ClusterFields) > 0 {
+		meta.Clustering = &bigquery.Clustering{Fields: c.spec.ClusterFields}
+	}
+	return meta
+}
+
+// Infer returns schema inferred from the records, columns are widened to fit values of
+// all of them. Partition column is made TIMESTAMP as its values are usually strings or epoch numbers
+func (c *TableCreator) Infer(records []simpleRecord) bigquery.Schema {
+	schema := make(bigquery.Schema, 0)
+	for _, rec := range records {
+		m := make(map[string]interface{}, len(rec))
+		for k, v := range rec {
+			m[k] = v
+		}
+		schema = widenSchema(schema, m)
+		schema, _ = extendSchema(schema, m, "", nil)
+	}
+
+	if c.spec.PartitionField == "" {
+		return schema
+	}
+	for i, f := range schema {
+		if !strings.EqualFold(f.Name, c.spec.PartitionField) {
+			continue
+		}
+		switch f.Type {
+		case bigquery.StringFieldType, bigquery.IntegerFieldType, bigquery.FloatFieldType:
+			pf := *f
+			pf.Type = bigquery.TimestampFieldType
+			schema[i] = &pf
+		}
+		return schema
+	}
+	return append(schema, &bigquery.FieldSchema{
+		Name: c.spec.PartitionField,
+		Type: bigquery.TimestampFieldType,
+	})
+}
+
+// widenSchema returns copy of schema with scalar columns widened to fit the values of rec,
+// integers become floats when the value isn't whole and mixed types become strings
+func widenSchema(schema bigquery.Schema, rec map[string]interface{}) bigquery.Schema {
+	values := make(map[string]interface{}, len(rec))
+	for k, v := range rec {
+		values[strings.ToLower(k)] = v
+	}
+	out := make(bigquery.Schema, 0, len(schema))
+	for _, f := range schema {
+		v, ok := values[strings.ToLower(f.Name)]
+		if !ok {
+			out = append(out, f)
+			continue
+		}
+		if f.Type == bigquery.RecordFieldType {
+			if nested := nestedRecord(v); nested != nil {
+				nf := *f
+				nf.Schema = widenSchema(f.Schema, nested)
+				f = &nf
+			}
+			out = append(out, f)
+			continue
+		}
+		vf := inferField(f.Name, v)
+		if vf == nil || vf.Type == bigquery.RecordFieldType || vf.Type == f.Type {
+			out = append(out, f)
+			continue
+		}
+		nf := *f
+		nf.Type = bigquery.StringFieldType
+		if isNumericType(f.Type) && isNumericType(vf.Type) {
+			nf.Type = bigquery.FloatFieldType
+		}
+		out = append(out, &nf)
+	}
+	return out
+}
+
+func isNumericType(t bigquery.FieldType) bool {
+	return t == bigquery.IntegerFieldType || t == bigquery.FloatFieldType
+}
+
+func (c *TableCreator) Close() error {
+	return c.client.Close()
+}
+
+// readFile reads file from local path or gs://bucket/object
+func readFile(ctx context.Context, path string) ([]byte, error) {
+	if !strings.HasPrefix(path, gcsScheme) {
+		return os.ReadFile(path)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, gcsScheme), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid file location: %s", path)
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage client: %v", err)
+	}
+	defer client.Close()
+	r, err := client.Bucket(parts[0]).Object(parts[1]).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// isAPIError checks whether err is google API error with the provided HTTP status code
+func isAPIError(err error, code int) bool {
+	var e *googleapi.Error
+	return errors.As(err, &e) && e.Code == code
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestTableCreatorInfer(t *testing.T) {
+	records := []simpleRecord{
+		{
+			"id":    "1",
+			"n":     json.Number("1"),
+			"flag":  true,
+			"ts":    json.Number("1640995200"),
+			"geo":   map[string]interface{}{"lat": json.Number("1")},
+			"empty": nil,
+		},
+		{
+			"ID":   "2",
+			"n":    json.Number("1.5"),
+			"flag": "yes",
+			"geo":  map[string]interface{}{"lat": json.Number("1.5"), "lon": json.Number("2")},
+			"tags": []interface{}{"a"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		spec TableSpec
+		want bigquery.Schema
+	}{
+		{
+			name: "widened across samples",
+			want: bigquery.Schema{
+				{Name: "id", Type: bigquery.StringFieldType},
+				{Name: "n", Type: bigquery.FloatFieldType},
+				{Name: "flag", Type: bigquery.StringFieldType},
+				{Name: "ts", Type: bigquery.IntegerFieldType},
+				{Name: "geo", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+					{Name: "lat", Type: bigquery.FloatFieldType},
+					{Name: "lon", Type: bigquery.IntegerFieldType},
+				}},
+				{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+			},
+		},
+		{
+			name: "partition field promoted",
+			spec: TableSpec{PartitionField: "TS"},
+			want: bigquery.Schema{
+				{Name: "id", Type: bigquery.StringFieldType},
+				{Name: "n", Type: bigquery.FloatFieldType},
+				{Name: "flag", Type: bigquery.StringFieldType},
+				{Name: "ts", Type: bigquery.TimestampFieldType},
+				{Name: "geo", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+					{Name: "lat", Type: bigquery.FloatFieldType},
+					{Name: "lon", Type: bigquery.IntegerFieldType},
+				}},
+				{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+			},
+		},
+		{
+			name: "missing partition field added",
+			spec: TableSpec{PartitionField: "created"},
+			want: bigquery.Schema{
+				{Name: "id", Type: bigquery.StringFieldType},
+				{Name: "n", Type: bigquery.FloatFieldType},
+				{Name: "flag", Type: bigquery.StringFieldType},
+				{Name: "ts", Type: bigquery.IntegerFieldType},
+				{Name: "geo", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+					{Name: "lat", Type: bigquery.FloatFieldType},
+					{Name: "lon", Type: bigquery.IntegerFieldType},
+				}},
+				{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+				{Name: "created", Type: bigquery.TimestampFieldType},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &TableCreator{spec: tt.spec}
+			got := c.Infer(records)
+			// columns of the first sample come in map order, compare them by name
+			if !reflect.DeepEqual(schemaByName(got), schemaByName(tt.want)) || len(got) != len(tt.want) {
+				t.Errorf("got schema %v, want %v", schemaByName(got), schemaByName(tt.want))
+			}
+		})
+	}
+}
+
+func TestTableCreatorMetadata(t *testing.T) {
+	schema := bigquery.Schema{{Name: "ts", Type: bigquery.TimestampFieldType}}
+	c := &TableCreator{spec: TableSpec{
+		PartitionType:  string(bigquery.HourPartitioningType),
+		PartitionField: "ts",
+		ClusterFields:  []string{"region", "type"},
+	}}
+	meta := c.metadata(schema)
+	if meta.TimePartitioning == nil || meta.TimePartitioning.Type != bigquery.HourPartitioningType ||
+		meta.TimePartitioning.Field != "ts" {
+		t.Errorf("got partitioning %+v, want hourly by ts", meta.TimePartitioning)
+	}
+	if meta.Clustering == nil || !reflect.DeepEqual(meta.Clustering.Fields, []string{"region", "type"}) {
+		t.Errorf("got clustering %+v, want region and type", meta.Clustering)
+	}
+
+	meta = (&TableCreator{}).metadata(schema)
+	if meta.TimePartitioning != nil || meta.Clustering != nil {
+		t.Errorf("got partitioning %+v and clustering %+v, want none", meta.TimePartitioning, meta.Clustering)
+	}
+}
+
+// schemaByName maps column names to their types, nested columns by dotted path
+func schemaByName(schema bigquery.Schema) map[string]string {
+	out := make(map[string]string)
+	for _, f := range schema {
+		for p, t := range fieldPaths(f, f.Name) {
+			out[p] = t
+		}
+	}
+	return out
+}
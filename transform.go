@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// transform cast types
+	castString    = "string"
+	castInteger   = "integer"
+	castFloat     = "float"
+	castBool      = "bool"
+	castTimestamp = "timestamp"
+	castJSON      = "json"
+
+	// flatten path matching all nested objects
+	flattenAll = "*"
+)
+
+// Transformer reshapes decoded records before they are routed and written.
+// Steps run in order: rename, drop, flatten, defaults, constants, and cast.
+// Renames and drops use dotted paths of the incoming record, the later steps
+// use the field names after renaming and flattening
+type Transformer struct {
+	renames   []*fieldRename
+	drop      []string
+	flatten   []string
+	separator string
+	defaults  map[string]interface{}
+	constants map[string]interface{}
+	casts     map[string]string
+}
+
+// fieldRename moves value from one dotted path to another
+type fieldRename struct {
+	from string
+	to   string
+}
+
+// NewTransformer creates transformer from the config, nil when no step is configured
+func NewTransformer(cfg TransformConfig) (*Transformer, error) {
+	if len(cfg.Rename) == 0 && len(cfg.Drop) == 0 && len(cfg.Flatten) == 0 &&
+		len(cfg.Defaults) == 0 && len(cfg.Constants) == 0 && len(cfg.Cast) == 0 {
+		return nil, nil
+	}
+
+	t := &Transformer{
+		renames:   make([]*fieldRename, 0, len(cfg.Rename)),
+		drop:      cfg.Drop,
+		flatten:   cfg.Flatten,
+		separator: cfg.FlattenSeparator,
+		defaults:  normalizeValues(cfg.Defaults),
+		constants: normalizeValues(cfg.Constants),
+		casts:     make(map[string]string, len(cfg.Cast)),
+	}
+	if len(t.flatten) > 0 && t.separator == "" {
+		return nil, fmt.Errorf("flatten separator required")
+	}
+	for _, p := range t.drop {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid drop pattern: %q", p)
+		}
+	}
+	for from, to := range cfg.Rename {
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("invalid rename, expected from=to: %q=%q", from, to)
+		}
+		t.renames = append(t.renames, &fieldRename{from: from, to: to})
+	}
+	// renames are applied in stable order so that chained renames behave the same each time
+	sort.Slice(t.renames, func(i, j int) bool { return t.renames[i].from < t.renames[j].from })
+	for field, typ := range cfg.Cast {
+		typ = strings.ToLower(typ)
+		switch typ {
+		case castString, castInteger, castFloat, castBool, castTimestamp, castJSON:
+		default:
+			return nil, fmt.Errorf("invalid cast type for %s: %s", field, typ)
+		}
+		t.casts[field] = typ
+	}
+	return t, nil
+}
+
+// Transform returns the record with the configured steps applied
+func (t *Transformer) Transform(rec simpleRecord) (simpleRecord, error) {
+	m := make(map[string]interface{}, len(rec))
+	for k, v := range rec {
+		m[k] = v
+	}
+
+	for _, r := range t.renames {
+		if v, ok := removePath(m, r.from); ok {
+			setPath(m, r.to, v)
+		}
+	}
+
+	if len(t.drop) > 0 {
+		dropFields(m, "", t.drop)
+	}
+
+	for _, p := range t.flatten {
+		if p == flattenAll {
+			m = flattenRecord(m, "", t.separator)
+			continue
+		}
+		nested, ok := m[p].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		delete(m, p)
+		for k, v := range flattenRecord(nested, p+t.separator, t.separator) {
+			m[k] = v
+		}
+	}
+
+	for k, v := range t.defaults {
+		if current, ok := m[k]; !ok || current == nil {
+			m[k] = v
+		}
+	}
+	for k, v := range t.constants {
+		m[k] = v
+	}
+
+	for k, typ := range t.casts {
+		v, ok := m[k]
+		if !ok || v == nil {
+			continue
+		}
+		cv, err := castValue(v, typ)
+		if err != nil {
+			return nil, fmt.Errorf("cast %s to %s: %v", k, typ, err)
+		}
+		m[k] = cv
+	}
+
+	out := make(simpleRecord, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out, nil
+}
+
+// removePath removes the value at dotted path and returns it
+func removePath(m map[string]interface{}, p string) (interface{}, bool) {
+	keys := strings.Split(p, ".")
+	for _, key := range keys[:len(keys)-1] {
+		nested, ok := m[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		m = nested
+	}
+	last := keys[len(keys)-1]
+	v, ok := m[last]
+	if ok {
+		delete(m, last)
+	}
+	return v, ok
+}
+
+// setPath sets the value at dotted path creating the missing objects on the way
+func setPath(m map[string]interface{}, p string, v interface{}) {
+	keys := strings.Split(p, ".")
+	for _, key := range keys[:len(keys)-1] {
+		nested, ok := m[key].(map[string]interface{})
+		if !ok {
+			nested = make(map[string]interface{})
+			m[key] = nested
+		}
+		m = nested
+	}
+	m[keys[len(keys)-1]] = v
+}
+
+// dropFields removes fields whose dotted paths match any of the patterns
+func dropFields(m map[string]interface{}, prefix string, patterns []string) {
+	for k, v := range m {
+		p := prefix + k
+		if matchesAny(p, patterns) {
+			delete(m, k)
+			continue
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			dropFields(nested, p+".", patterns)
+		}
+	}
+}
+
+// matchesAny checks dotted field path against the patterns, case insensitive
+func matchesAny(p string, patterns []string) bool {
+	p = strings.ToLower(p)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// flattenRecord returns record with nested objects replaced by their fields
+// named by the prefixed path joined with separator, arrays are kept as they are
+func flattenRecord(m map[string]interface{}, prefix, separator string) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if nested, ok := v.(map[string]interface{}); ok && len(nested) > 0 {
+			for fk, fv := range flattenRecord(nested, prefix+k+separator, separator) {
+				out[fk] = fv
+			}
+			continue
+		}
+		out[prefix+k] = v
+	}
+	return out
+}
+
+// normalizeValues converts values decoded from YAML config into their decoded JSON form
+func normalizeValues(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = normalizeValue(v)
+	}
+	return out
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case int, int64, uint64, float64:
+		return json.Number(fmt.Sprint(t))
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			m[fmt.Sprint(k)] = normalizeValue(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(t))
+		for i, item := range t {
+			list[i] = normalizeValue(item)
+		}
+		return list
+	default:
+		return v
+	}
+}
+
+// castValue converts value to the cast type keeping it in the decoded JSON form
+// (numbers as json.Number, timestamps as RFC3339 strings) so it can still be coerced
+func castValue(v interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case castString:
+		return toString(v)
+	case castInteger:
+		n, err := toInteger(v)
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatInt(n, 10)), nil
+	case castFloat:
+		f, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	case castBool:
+		return toBool(v)
+	case castTimestamp:
+		ts, err := toTimestamp(v)
+		if err != nil {
+			return nil, err
+		}
+		return ts.UTC().Format(time.RFC3339Nano), nil
+	case castJSON:
+		return toJSONString(v)
+	default:
+		return nil, fmt.Errorf("invalid cast type: %s", typ)
+	}
+}
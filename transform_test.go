@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  TransformConfig
+		in   simpleRecord
+		want simpleRecord
+	}{
+		{
+			name: "chained renames",
+			cfg:  TransformConfig{Rename: map[string]string{"a": "b", "b": "c"}},
+			in:   simpleRecord{"a": "1", "b": "2"},
+			want: simpleRecord{"c": "1"},
+		},
+		{
+			name: "dotted paths",
+			cfg: TransformConfig{
+				Rename: map[string]string{"user.id": "user_id", "ts": "meta.time"},
+				Drop:   []string{"user.secret*"},
+			},
+			in: simpleRecord{
+				"user": map[string]interface{}{"id": "u1", "secret_key": "x", "name": "a"},
+				"ts":   "2022-01-01T00:00:00Z",
+			},
+			want: simpleRecord{
+				"user_id": "u1",
+				"user":    map[string]interface{}{"name": "a"},
+				"meta":    map[string]interface{}{"time": "2022-01-01T00:00:00Z"},
+			},
+		},
+		{
+			name: "flatten all with separator",
+			cfg:  TransformConfig{Flatten: []string{flattenAll}, FlattenSeparator: "__"},
+			in: simpleRecord{
+				"id":    "1",
+				"geo":   map[string]interface{}{"lat": json.Number("1.5"), "pos": map[string]interface{}{"x": "a"}},
+				"tags":  []interface{}{"a"},
+				"empty": map[string]interface{}{},
+			},
+			want: simpleRecord{
+				"id":          "1",
+				"geo__lat":    json.Number("1.5"),
+				"geo__pos__x": "a",
+				"tags":        []interface{}{"a"},
+				"empty":       map[string]interface{}{},
+			},
+		},
+		{
+			name: "flatten single field",
+			cfg:  TransformConfig{Flatten: []string{"geo"}, FlattenSeparator: "_"},
+			in: simpleRecord{
+				"geo":  map[string]interface{}{"lat": "1"},
+				"user": map[string]interface{}{"id": "u1"},
+			},
+			want: simpleRecord{
+				"geo_lat": "1",
+				"user":    map[string]interface{}{"id": "u1"},
+			},
+		},
+		{
+			name: "defaults and constants",
+			cfg: TransformConfig{
+				Defaults:  map[string]interface{}{"missing": "d", "null": "d", "set": "d", "both": "d"},
+				Constants: map[string]interface{}{"version": 2, "both": "c"},
+			},
+			in:   simpleRecord{"null": nil, "set": "v", "version": "1"},
+			want: simpleRecord{"missing": "d", "null": "d", "set": "v", "both": "c", "version": json.Number("2")},
+		},
+		{
+			name: "casts",
+			cfg: TransformConfig{Cast: map[string]string{
+				"n": castInteger, "f": castFloat, "b": castBool, "s": castString,
+				"ts": castTimestamp, "j": castJSON, "nil": castInteger,
+			}},
+			in: simpleRecord{
+				"n": "42", "f": "1.5", "b": "true", "s": json.Number("7"),
+				"ts": json.Number("1640995200"), "j": map[string]interface{}{"a": "b"}, "nil": nil,
+			},
+			want: simpleRecord{
+				"n": json.Number("42"), "f": json.Number("1.5"), "b": true, "s": "7",
+				"ts": "2022-01-01T00:00:00Z", "j": `{"a":"b"}`, "nil": nil,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := NewTransformer(tt.cfg)
+			if err != nil {
+				t.Fatalf("error creating transformer: %v", err)
+			}
+			got, err := tr.Transform(tt.in)
+			if err != nil {
+				t.Fatalf("error transforming: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformCastFailures(t *testing.T) {
+	tests := []struct {
+		typ string
+		in  interface{}
+	}{
+		{castInteger, "abc"},
+		{castFloat, "1.5x"},
+		{castBool, "maybe"},
+		{castTimestamp, "yesterday"},
+	}
+	for _, tt := range tests {
+		tr, err := NewTransformer(TransformConfig{Cast: map[string]string{"v": tt.typ}})
+		if err != nil {
+			t.Fatalf("error creating transformer: %v", err)
+		}
+		if _, err := tr.Transform(simpleRecord{"v": tt.in}); err == nil {
+			t.Errorf("cast of %v to %s: expected error", tt.in, tt.typ)
+		}
+	}
+}
+
+func TestNewTransformerInvalid(t *testing.T) {
+	for name, c := range map[string]TransformConfig{
+		"cast type":         {Cast: map[string]string{"v": "decimal"}},
+		"flatten separator": {Flatten: []string{flattenAll}},
+		"drop pattern":      {Drop: []string{"[a"}},
+		"rename":            {Rename: map[string]string{"a": ""}},
+	} {
+		if _, err := NewTransformer(c); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if tr, err := NewTransformer(TransformConfig{}); tr != nil || err != nil {
+		t.Errorf("got transformer %v, error %v, want none without steps", tr, err)
+	}
+}